@@ -2,16 +2,23 @@ CREATE TABLE user (
   id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name VARCHAR(191) UNIQUE,
   salt VARCHAR(20),
-  password VARCHAR(40),
+  password VARCHAR(255),
   display_name TEXT,
   avatar_icon TEXT,
-  created_at DATETIME NOT NULL
+  avatar_icon_32 VARCHAR(191) NOT NULL DEFAULT '',
+  avatar_icon_64 VARCHAR(191) NOT NULL DEFAULT '',
+  avatar_icon_128 VARCHAR(191) NOT NULL DEFAULT '',
+  role VARCHAR(16) NOT NULL DEFAULT 'member',
+  created_at DATETIME NOT NULL,
+  deleted_at DATETIME NULL,
+  banned_at DATETIME NULL
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE image (
   id BIGINT UNSIGNED AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name VARCHAR(191),
   data LONGBLOB,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
   KEY name_index_on_image(name)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
@@ -19,8 +26,10 @@ CREATE TABLE channel (
   id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
   name TEXT NOT NULL,
   description MEDIUMTEXT,
+  created_by BIGINT NOT NULL DEFAULT 0,
   updated_at DATETIME NOT NULL,
-  created_at DATETIME NOT NULL
+  created_at DATETIME NOT NULL,
+  archived_at DATETIME NULL
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
 
 CREATE TABLE message (
@@ -28,6 +37,9 @@ CREATE TABLE message (
   channel_id BIGINT,
   user_id BIGINT,
   content TEXT,
+  kind VARCHAR(16) NOT NULL DEFAULT 'text',
+  sender_name VARCHAR(64) NOT NULL DEFAULT '',
+  sender_icon VARCHAR(255) NOT NULL DEFAULT '',
   created_at DATETIME NOT NULL,
   KEY channel_id_index_on_message(channel_id)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
@@ -40,3 +52,127 @@ CREATE TABLE haveread (
   created_at DATETIME NOT NULL,
   PRIMARY KEY(user_id, channel_id)
 ) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE user_totp (
+  user_id BIGINT NOT NULL PRIMARY KEY,
+  secret VARCHAR(64) NOT NULL,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  enabled_at DATETIME NULL,
+  created_at DATETIME NOT NULL
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE totp_recovery_code (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  code_hash CHAR(64) NOT NULL,
+  used_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  KEY user_id_index_on_totp_recovery_code(user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE user_identity (
+  issuer VARCHAR(191) NOT NULL,
+  subject VARCHAR(191) NOT NULL,
+  user_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(issuer, subject),
+  KEY user_id_index_on_user_identity(user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE sidebar_section (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  position BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  KEY user_id_index_on_sidebar_section(user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE user_channel (
+  user_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL,
+  starred TINYINT(1) NOT NULL DEFAULT 0,
+  muted TINYINT(1) NOT NULL DEFAULT 0,
+  notify VARCHAR(16) NOT NULL DEFAULT 'all',
+  section_id BIGINT NOT NULL DEFAULT 0,
+  updated_at DATETIME NOT NULL,
+  PRIMARY KEY(user_id, channel_id),
+  KEY channel_id_index_on_user_channel(channel_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE pinned_message (
+  channel_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL,
+  pinned_by BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(channel_id, message_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE saved_message (
+  user_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  PRIMARY KEY(user_id, message_id),
+  KEY message_id_index_on_saved_message(message_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE scheduled_message (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  kind VARCHAR(16) NOT NULL,
+  user_id BIGINT NOT NULL,
+  channel_id BIGINT NOT NULL,
+  message_id BIGINT NOT NULL DEFAULT 0,
+  content TEXT NOT NULL,
+  deliver_at DATETIME NOT NULL,
+  status VARCHAR(16) NOT NULL DEFAULT 'pending',
+  delivered_at DATETIME NULL,
+  created_at DATETIME NOT NULL,
+  KEY status_deliver_at_index_on_scheduled_message(status, deliver_at),
+  KEY user_id_index_on_scheduled_message(user_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE incoming_webhook (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  channel_id BIGINT NOT NULL,
+  user_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  token_hash CHAR(64) NOT NULL,
+  created_by BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  last_used_at DATETIME NULL,
+  revoked_at DATETIME NULL,
+  UNIQUE KEY token_hash_index_on_incoming_webhook(token_hash),
+  KEY channel_id_index_on_incoming_webhook(channel_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE outgoing_webhook (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  channel_id BIGINT NOT NULL,
+  name VARCHAR(64) NOT NULL,
+  url VARCHAR(255) NOT NULL,
+  secret VARCHAR(64) NOT NULL,
+  trigger_words VARCHAR(255) NOT NULL DEFAULT '',
+  created_by BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  revoked_at DATETIME NULL,
+  KEY channel_id_index_on_outgoing_webhook(channel_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE attachment (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  message_id BIGINT NOT NULL,
+  name VARCHAR(191) NOT NULL,
+  filename VARCHAR(255) NOT NULL,
+  content_type VARCHAR(128) NOT NULL,
+  size BIGINT NOT NULL,
+  created_at DATETIME NOT NULL,
+  KEY message_id_index_on_attachment(message_id)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
+
+CREATE TABLE attachment_blob (
+  id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+  name VARCHAR(191) NOT NULL,
+  data LONGBLOB NOT NULL,
+  created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  UNIQUE KEY name_index_on_attachment_blob(name)
+) Engine=InnoDB DEFAULT CHARSET=utf8mb4;
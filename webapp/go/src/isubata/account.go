@@ -0,0 +1,187 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	deletedUserDisplayName = "退会済みユーザー"
+)
+
+func updatePassword(userID int64, password string) error {
+	digest, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE user SET salt = '', password = ? WHERE id = ?", digest, userID)
+	if err != nil {
+		return err
+	}
+	return revokeUserSessions(userID)
+}
+
+// deleteAccount はユーザを退会済みにする
+// メッセージは残し、anonymize の場合は名前とアイコンを消す
+func deleteAccount(userID int64, anonymize bool) error {
+	var err error
+	if anonymize {
+		_, err = db.Exec(
+			"UPDATE user SET name = CONCAT('deleted-', id), salt = '', password = '',"+
+				" display_name = ?, avatar_icon = ?, avatar_icon_32 = '', avatar_icon_64 = '', avatar_icon_128 = '',"+
+				" deleted_at = NOW() WHERE id = ?",
+			deletedUserDisplayName, "default.png", userID)
+	} else {
+		_, err = db.Exec("UPDATE user SET salt = '', password = '', deleted_at = NOW() WHERE id = ?", userID)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM totp_recovery_code WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM user_channel WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM sidebar_section WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM saved_message WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM scheduled_message WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	return revokeUserSessions(userID)
+}
+
+// hasLinkedIdentity は IdP と連携しているかどうか
+func hasLinkedIdentity(userID int64) (bool, error) {
+	var n int
+	err := db.Get(&n, "SELECT COUNT(*) FROM user_identity WHERE user_id = ?", userID)
+	return n > 0, err
+}
+
+// verifyReauth はパスワード変更や退会の前の本人確認
+// パスワードを持たず IdP と連携しているユーザは、直近に IdP で認証していればよい
+func verifyReauth(c echo.Context, u *User, password string) (bool, error) {
+	if u.Password != "" {
+		ok, _, err := verifyPassword(u, password)
+		return ok, err
+	}
+	linked, err := hasLinkedIdentity(u.ID)
+	if err != nil || !linked {
+		return false, err
+	}
+	sess, _ := session.Get("session", c)
+	at, _ := sess.Values["oidc_authenticated_at"].(int64)
+	return at != 0 && oidcNow().Unix()-at <= oidcReauthTTL, nil
+}
+
+//request handlers
+
+func getAccount(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "account", map[string]interface{}{
+		"ChannelID":   0,
+		"Sidebar":     sidebar,
+		"User":        self,
+		"OIDCEnabled": getOIDCProvider() != nil,
+		"HasPassword": self.Password != "",
+	})
+}
+
+func postAccountPassword(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	current := c.FormValue("current_password")
+	pw := c.FormValue("new_password")
+	if (self.Password != "" && current == "") || pw == "" || pw != c.FormValue("new_password_confirm") {
+		return ErrBadReqeust
+	}
+	ok, err := verifyReauth(c, self, current)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.ErrForbidden
+	}
+
+	if err := updatePassword(self.ID, pw); err != nil {
+		return err
+	}
+	// 他のセッションは無効になるので、このセッションだけ張り直す
+	sessSetUserID(c, self.ID)
+	return c.Redirect(http.StatusSeeOther, "/account")
+}
+
+func postAccountName(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	name := c.FormValue("name")
+	if name == "" || reservedUserName(name) {
+		return ErrBadReqeust
+	}
+	_, err = db.Exec("UPDATE user SET name = ? WHERE id = ?", name, self.ID)
+	if err != nil {
+		if merr, ok := err.(*mysql.MySQLError); ok {
+			if merr.Number == 1062 { // Duplicate entry xxxx for key zzzz
+				return c.NoContent(http.StatusConflict)
+			}
+		}
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/account")
+}
+
+func postAccountDelete(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	var anonymize bool
+	switch c.FormValue("messages") {
+	case "anonymize":
+		anonymize = true
+	case "keep":
+		anonymize = false
+	default:
+		return ErrBadReqeust
+	}
+
+	ok, err := verifyReauth(c, self, c.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.ErrForbidden
+	}
+
+	if err := deleteAccount(self.ID, anonymize); err != nil {
+		return err
+	}
+	sessClearUserID(c)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
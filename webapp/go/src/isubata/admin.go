@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	adminUsersPerPage = 50
+)
+
+// ensureAdmin はログインしていなければ /login へ、管理者でなければ 403 を返す
+func ensureAdmin(c echo.Context) (*User, error) {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return nil, err
+	}
+	if !self.IsAdmin() {
+		return nil, echo.ErrForbidden
+	}
+	return self, nil
+}
+
+func getUserByName(name string) (*User, error) {
+	u := User{}
+	if err := db.Get(&u, "SELECT * FROM user WHERE name = ? AND deleted_at IS NULL", name); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &u, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func redirectToAdminUsers(c echo.Context) error {
+	u := "/admin/users"
+	if q := c.FormValue("q"); q != "" {
+		u += "?q=" + url.QueryEscape(q)
+	}
+	return c.Redirect(http.StatusSeeOther, u)
+}
+
+//request handlers
+
+func getAdmin(c echo.Context) error {
+	return c.Redirect(http.StatusSeeOther, "/admin/users")
+}
+
+func getAdminUsers(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	var page int64 = 1
+	if s := c.QueryParam("page"); s != "" {
+		page, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || page < 1 {
+			return ErrBadReqeust
+		}
+	}
+
+	q := c.QueryParam("q")
+	users := []User{}
+	if q == "" {
+		err = db.Select(&users,
+			"SELECT * FROM user WHERE deleted_at IS NULL ORDER BY id LIMIT ? OFFSET ?",
+			adminUsersPerPage+1, (page-1)*adminUsersPerPage)
+	} else {
+		like := "%" + escapeLike(q) + "%"
+		err = db.Select(&users,
+			"SELECT * FROM user WHERE deleted_at IS NULL AND (name LIKE ? OR display_name LIKE ?)"+
+				" ORDER BY id LIMIT ? OFFSET ?",
+			like, like, adminUsersPerPage+1, (page-1)*adminUsersPerPage)
+	}
+	if err != nil {
+		return err
+	}
+	hasNext := len(users) > adminUsersPerPage
+	if hasNext {
+		users = users[:adminUsersPerPage]
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "admin_users", map[string]interface{}{
+		"ChannelID": 0,
+		"Sidebar":   sidebar,
+		"User":      self,
+		"Users":     users,
+		"Query":     q,
+		"Page":      page,
+		"HasNext":   hasNext,
+		"Roles":     []Role{RoleAdmin, RoleMember, RoleGuest},
+	})
+}
+
+func postAdminUserRole(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	role := Role(c.FormValue("role"))
+	if !validRole(role) {
+		return ErrBadReqeust
+	}
+	other, err := getUserByName(c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+	// 自分の権限を外して管理者がいなくなるのを防ぐ
+	if other.ID == self.ID && role != RoleAdmin {
+		return ErrBadReqeust
+	}
+	// bot と webhook のユーザは role = bot のままでないといけない
+	if other.Role == RoleBot {
+		return ErrBadReqeust
+	}
+
+	if _, err := db.Exec("UPDATE user SET role = ? WHERE id = ?", role, other.ID); err != nil {
+		return err
+	}
+	return redirectToAdminUsers(c)
+}
+
+func postAdminBanUser(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	other, err := getUserByName(c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+	if other.ID == self.ID {
+		return ErrBadReqeust
+	}
+
+	if _, err := db.Exec("UPDATE user SET banned_at = NOW() WHERE id = ? AND banned_at IS NULL", other.ID); err != nil {
+		return err
+	}
+	if err := revokeUserSessions(other.ID); err != nil {
+		return err
+	}
+	return redirectToAdminUsers(c)
+}
+
+func postAdminUnbanUser(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	other, err := getUserByName(c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+
+	if _, err := db.Exec("UPDATE user SET banned_at = NULL WHERE id = ?", other.ID); err != nil {
+		return err
+	}
+	return redirectToAdminUsers(c)
+}
+
+func postAdminResetAvatar(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	other, err := getUserByName(c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+
+	_, err = db.Exec("UPDATE user SET avatar_icon = ?, avatar_icon_32 = '', avatar_icon_64 = '', avatar_icon_128 = ''"+
+		" WHERE id = ?", "default.png", other.ID)
+	if err != nil {
+		return err
+	}
+	return redirectToAdminUsers(c)
+}
+
+// 管理者がパスワードを再発行する。新しいパスワードはレスポンスでのみ返す
+func postAdminResetPassword(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	other, err := getUserByName(c.Param("user_name"))
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return echo.ErrNotFound
+	}
+	// bot にパスワードを付けると、そのユーザとしてログインできてしまう
+	if other.Role == RoleBot {
+		return ErrBadReqeust
+	}
+
+	pw := secureRandomString(16)
+	if err := updatePassword(other.ID, pw); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"name":     other.Name,
+		"password": pw,
+	})
+}
+
+func getAdminChannels(c echo.Context) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	all := []ChannelInfo{}
+	err = db.Select(&all, "SELECT * FROM channel ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "admin_channels", map[string]interface{}{
+		"ChannelID":   0,
+		"Sidebar":     sidebar,
+		"User":        self,
+		"AllChannels": all,
+	})
+}
+
+func postAdminArchiveChannel(c echo.Context) error {
+	return adminSetChannelArchived(c, true)
+}
+
+func postAdminUnarchiveChannel(c echo.Context) error {
+	return adminSetChannelArchived(c, false)
+}
+
+func adminSetChannelArchived(c echo.Context, archived bool) error {
+	self, err := ensureAdmin(c)
+	if self == nil {
+		return err
+	}
+
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if err := setChannelArchived(chID, archived); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/admin/channels#channel-%d", chID))
+}
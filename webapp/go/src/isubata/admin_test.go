@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+// bot と webhook のユーザは権限の変更もパスワードの再発行もできず、ログインもできない
+func TestBotUsersCannotBeManagedOrLogIn(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("botadm")
+	adminID := insertTestUser(t, name, RoleAdmin)
+	defer db.Exec("DELETE FROM user WHERE id = ?", adminID)
+	botID := insertTestUser(t, name+"-bot", RoleBot)
+	defer db.Exec("DELETE FROM user WHERE id = ?", botID)
+
+	e, app := newTestApp(t)
+	defer app.Close()
+	e.POST("/admin/users/:user_name/role", postAdminUserRole)
+	e.POST("/admin/users/:user_name/reset_password", postAdminResetPassword)
+	e.POST("/login", postLogin)
+	client := newTestClient(t, app, adminID)
+
+	post := func(client *http.Client, path string, form url.Values) int {
+		res, err := client.PostForm(app.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := post(client, "/admin/users/"+name+"-bot/role", url.Values{"role": {"admin"}}); status != http.StatusBadRequest {
+		t.Errorf("role: status %d", status)
+	}
+	if status := post(client, "/admin/users/"+name+"-bot/reset_password", nil); status != http.StatusBadRequest {
+		t.Errorf("reset_password: status %d", status)
+	}
+	bot, err := getUser(botID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.Role != RoleBot || bot.Password != "" {
+		t.Errorf("bot = %+v", bot)
+	}
+
+	// パスワードが付いていてもログインできない
+	if err := updatePassword(botID, "bot-password"); err != nil {
+		t.Fatal(err)
+	}
+	anon := newTestClient(t, app, 0)
+	form := url.Values{"name": {name + "-bot"}, "password": {"bot-password"}}
+	if status := post(anon, "/login", form); status != http.StatusForbidden {
+		t.Errorf("login as bot: status %d", status)
+	}
+
+	// 人のユーザは今まで通り
+	if status := post(client, "/admin/users/"+name+"/role", url.Values{"role": {"member"}}); status != http.StatusBadRequest {
+		t.Errorf("demote self: status %d", status)
+	}
+}
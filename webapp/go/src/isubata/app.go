@@ -9,9 +9,9 @@ import (
 	"math/rand"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
-	"github.com/gorilla/sessions"
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
@@ -31,7 +31,9 @@ func init() {
 	seedBuf := make([]byte, 8)
 	crand.Read(seedBuf)
 	rand.Seed(int64(binary.LittleEndian.Uint64(seedBuf)))
+}
 
+func dbDSN() string {
 	db_host := os.Getenv("ISUBATA_DB_HOST")
 	if db_host == "" {
 		db_host = "127.0.0.1"
@@ -49,11 +51,16 @@ func init() {
 		db_password = ":" + db_password
 	}
 
-	dsn := fmt.Sprintf("%s%s@tcp(%s:%s)/isubata?parseTime=true&loc=Local&charset=utf8mb4",
+	return fmt.Sprintf("%s%s@tcp(%s:%s)/isubata?parseTime=true&loc=Local&charset=utf8mb4",
 		db_user, db_password, db_host, db_port)
+}
 
+// connectDB は DB につながるまで待つ。テストは DB 無しでも動かせるよう init ではなく main で呼ぶ
+func connectDB() {
+	dsn := dbDSN()
 	log.Printf("Connecting to db: %q", dsn)
-	db, _ = sqlx.Connect("mysql", dsn)
+	// Connect は最初の Ping に失敗すると nil を返すので、Open してから待つ
+	db, _ = sqlx.Open("mysql", dsn)
 	for {
 		err := db.Ping()
 		if err == nil {
@@ -75,6 +82,18 @@ func getInitialize(c echo.Context) error {
 	db.MustExec("DELETE FROM channel WHERE id > 10")
 	db.MustExec("DELETE FROM message WHERE id > 10000")
 	db.MustExec("DELETE FROM haveread")
+	db.MustExec("DELETE FROM user_totp WHERE user_id > 1000")
+	db.MustExec("DELETE FROM totp_recovery_code WHERE user_id > 1000")
+	db.MustExec("DELETE FROM user_identity WHERE user_id > 1000")
+	db.MustExec("DELETE FROM user_channel WHERE user_id > 1000 OR channel_id > 10")
+	db.MustExec("DELETE FROM sidebar_section WHERE user_id > 1000")
+	db.MustExec("DELETE FROM pinned_message")
+	db.MustExec("DELETE FROM saved_message")
+	db.MustExec("DELETE FROM scheduled_message")
+	db.MustExec("DELETE FROM incoming_webhook")
+	db.MustExec("DELETE FROM outgoing_webhook")
+	db.MustExec("DELETE FROM attachment")
+	db.MustExec("DELETE FROM attachment_blob")
 	r, err := NewRedisful()
 	r.FLUSH_ALL()
 	r.Close()
@@ -109,6 +128,11 @@ func getIndex(c echo.Context) error {
 }
 
 func main() {
+	connectDB()
+	if len(os.Args) > 1 && os.Args[1] == "gc-avatars" {
+		os.Exit(runAvatarGCCommand(os.Args[2:]))
+	}
+
 	e := echo.New()
 	funcs := template.FuncMap{
 		"add":    tAdd,
@@ -117,31 +141,106 @@ func main() {
 	e.Renderer = &Renderer{
 		templates: template.Must(template.New("").Funcs(funcs).ParseGlob("views/*.html")),
 	}
-	e.Use(session.Middleware(sessions.NewCookieStore([]byte("secretonymoris"))))
+	sessionConfig, err := loadSessionConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	e.Use(session.Middleware(newSessionStore(sessionConfig)))
+	e.Use(csrfMiddleware(sessionConfig.Secure))
 	e.Use(middleware.LoggerWithConfig(middleware.LoggerConfig{
 		Format: "request:\"${method} ${uri}\" status:${status} latency:${latency} (${latency_human}) bytes:${bytes_out}\n",
 	}))
-	e.Use(middleware.Static("../public"))
+	// アイコンは BlobStore から返す
+	e.Use(middleware.StaticWithConfig(middleware.StaticConfig{
+		Root: "../public",
+		Skipper: func(c echo.Context) bool {
+			return strings.HasPrefix(c.Request().URL.Path, "/icons/")
+		},
+	}))
 
 	e.GET("/initialize", getInitialize)
 	e.GET("/", getIndex)
 	e.GET("/register", getRegister)
-	e.POST("/register", postRegister)
+	e.POST("/register", postRegister, rateLimitMiddleware(registerRateLimit))
 	e.GET("/login", getLogin)
-	e.POST("/login", postLogin)
+	e.POST("/login", postLogin, rateLimitMiddleware(loginRateLimit))
+	e.GET("/login/totp", getLoginTOTP)
+	e.POST("/login/totp", postLoginTOTP, rateLimitMiddleware(loginRateLimit))
+	e.GET("/login/oidc", getLoginOIDC)
+	e.GET("/login/oidc/callback", getLoginOIDCCallback)
 	e.GET("/logout", getLogout)
 
 	e.GET("/channel/:channel_id", getChannel)
 	e.GET("/message", getMessage)
-	e.POST("/message", postMessage)
+	e.POST("/message", postMessage, rateLimitMiddleware(messageRateLimit))
+	e.GET("/attachments/:attachment_id/:filename", getAttachmentFile)
 	e.GET("/fetch", fetchUnread)
+	e.POST("/channel/:channel_id/read", postChannelRead)
+	e.POST("/channel/:channel_id/presence", postPresence)
+	e.POST("/channel/:channel_id/typing", postTyping)
+	e.POST("/read/all", postReadAll)
+	e.GET("/channel/:channel_id/pins", getPins)
+	e.POST("/channel/:channel_id/pins", postPin)
+	e.POST("/channel/:channel_id/pins/:message_id/delete", postUnpin)
+	e.GET("/saved", getSaved)
+	e.GET("/saved/messages", getSavedMessages)
+	e.POST("/saved/messages", postSavedMessage)
+	e.POST("/saved/messages/:message_id/delete", postUnsaveMessage)
+	e.GET("/scheduled", getScheduled)
+	e.POST("/scheduled/messages", postScheduledMessage)
+	e.POST("/scheduled/reminders", postReminder)
+	e.POST("/scheduled/:scheduled_id/cancel", postCancelScheduled)
 	e.GET("/history/:channel_id", getHistory)
-
+	e.GET("/channel/:channel_id/edit", getEditChannel)
+	e.POST("/channel/:channel_id/edit", postEditChannel)
+	e.POST("/channel/:channel_id/archive", postArchiveChannel)
+	e.POST("/channel/:channel_id/unarchive", postUnarchiveChannel)
+	e.POST("/channel/:channel_id/delete", postDeleteChannel)
+	e.POST("/channel/:channel_id/webhooks", postIncomingWebhook)
+	e.POST("/channel/:channel_id/webhooks/:webhook_id/revoke", postRevokeIncomingWebhook)
+	e.POST("/hooks/:token", postHook, rateLimitMiddleware(webhookRateLimit))
+	e.POST("/channel/:channel_id/outgoing_webhooks", postOutgoingWebhook)
+	e.POST("/channel/:channel_id/outgoing_webhooks/:webhook_id/revoke", postRevokeOutgoingWebhook)
+	e.GET("/channel/:channel_id/outgoing_webhooks/:webhook_id", getOutgoingWebhookDeliveries)
+	e.POST("/channel/:channel_id/sidebar", postChannelSidebar)
+	e.GET("/sidebar", getSidebarSettings)
+	e.POST("/sidebar/sections", postSidebarSection)
+	e.POST("/sidebar/sections/:section_id/rename", postRenameSidebarSection)
+	e.POST("/sidebar/sections/:section_id/delete", postDeleteSidebarSection)
+
+	e.GET("/icons/:file_name", getIcon)
 	e.GET("/profile/:user_name", getProfile)
 	e.POST("/profile", postProfile)
+	e.GET("/account", getAccount)
+	e.POST("/account/password", postAccountPassword)
+	e.POST("/account/name", postAccountName)
+	e.POST("/account/delete", postAccountDelete)
+	e.GET("/account/totp", getAccountTOTP)
+	e.POST("/account/totp/setup", postAccountTOTPSetup)
+	e.POST("/account/totp/confirm", postAccountTOTPConfirm)
+	e.POST("/account/totp/recovery_codes", postAccountTOTPRecoveryCodes)
+	e.POST("/account/totp/disable", postAccountTOTPDisable)
+	e.GET("/sessions", getSessions)
+	e.POST("/sessions/revoke_all", postRevokeAllSessions)
+	e.POST("/sessions/:session_id/revoke", postRevokeSession)
 
 	e.GET("add_channel", getAddChannel)
 	e.POST("add_channel", postAddChannel)
 
+	e.GET("/admin", getAdmin)
+	e.GET("/admin/users", getAdminUsers)
+	e.POST("/admin/users/:user_name/role", postAdminUserRole)
+	e.POST("/admin/users/:user_name/ban", postAdminBanUser)
+	e.POST("/admin/users/:user_name/unban", postAdminUnbanUser)
+	e.POST("/admin/users/:user_name/reset_avatar", postAdminResetAvatar)
+	e.POST("/admin/users/:user_name/reset_password", postAdminResetPassword)
+	e.GET("/admin/channels", getAdminChannels)
+	e.POST("/admin/channels/:channel_id/archive", postAdminArchiveChannel)
+	e.POST("/admin/channels/:channel_id/unarchive", postAdminUnarchiveChannel)
+
+	go runScheduler()
+	startOutgoingWebhookWorkers()
+	startAvatarGC()
+
 	e.Start(":5000")
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+const (
+	attachmentMaxBytes          = 10 * 1024 * 1024
+	maxAttachmentsPerMessage    = 5
+	maxAttachmentFilenameLength = 255
+)
+
+// 添付できる拡張子と配信するときの Content-Type
+var attachmentContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".pdf":  "application/pdf",
+	".txt":  "text/plain; charset=utf-8",
+	".log":  "text/plain; charset=utf-8",
+	".csv":  "text/csv; charset=utf-8",
+	".json": "application/json",
+	".zip":  "application/zip",
+}
+
+type Attachment struct {
+	ID        int64 `db:"id"`
+	MessageID int64 `db:"message_id"`
+	// BlobStore 上の名前。内容の sha1 と拡張子
+	Name        string    `db:"name"`
+	Filename    string    `db:"filename"`
+	ContentType string    `db:"content_type"`
+	Size        int64     `db:"size"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+func (a Attachment) URL() string {
+	return fmt.Sprintf("/attachments/%d/%s", a.ID, url.PathEscape(a.Filename))
+}
+
+func (a Attachment) IsImage() bool {
+	return strings.HasPrefix(a.ContentType, "image/")
+}
+
+func jsonifyAttachment(a Attachment) map[string]interface{} {
+	return map[string]interface{}{
+		"id":           a.ID,
+		"filename":     a.Filename,
+		"content_type": a.ContentType,
+		"size":         a.Size,
+		"url":          a.URL(),
+		"is_image":     a.IsImage(),
+	}
+}
+
+// attachmentUpload は検査済みでまだ保存していない添付
+type attachmentUpload struct {
+	Attachment
+	Data []byte
+}
+
+// readAttachments は POST /message の attachment を読む。アバターと同じく拡張子と大きさを検査する
+func readAttachments(c echo.Context) ([]attachmentUpload, error) {
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		return nil, nil
+	}
+	form, err := c.MultipartForm()
+	if err != nil {
+		return nil, ErrBadReqeust
+	}
+	files := form.File["attachment"]
+	if len(files) > maxAttachmentsPerMessage {
+		return nil, ErrBadReqeust
+	}
+
+	uploads := make([]attachmentUpload, 0, len(files))
+	for _, fh := range files {
+		u, err := readAttachment(fh)
+		if err != nil {
+			return nil, err
+		}
+		uploads = append(uploads, u)
+	}
+	return uploads, nil
+}
+
+func readAttachment(fh *multipart.FileHeader) (attachmentUpload, error) {
+	var u attachmentUpload
+	filename := filepath.Base(strings.Replace(fh.Filename, "\\", "/", -1))
+	if filename == "" || filename == "." || filename == "/" || len(filename) > maxAttachmentFilenameLength {
+		return u, ErrBadReqeust
+	}
+	ext := strings.ToLower(filepath.Ext(filename))
+	contentType, ok := attachmentContentTypes[ext]
+	if !ok {
+		return u, ErrBadReqeust
+	}
+	if fh.Size > attachmentMaxBytes {
+		return u, ErrBadReqeust
+	}
+
+	file, err := fh.Open()
+	if err != nil {
+		return u, err
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return u, err
+	}
+	if len(data) == 0 || len(data) > attachmentMaxBytes {
+		return u, ErrBadReqeust
+	}
+
+	u.Name = fmt.Sprintf("%x%s", sha1.Sum(data), ext)
+	u.Filename = filename
+	u.ContentType = contentType
+	u.Size = int64(len(data))
+	u.Data = data
+	return u, nil
+}
+
+// putAttachmentBlobs はメッセージを書く前に BlobStore に置く
+// 同じ内容のファイルは同じ名前になるので、送り直しで置き直しても中身は変わらない
+func putAttachmentBlobs(uploads []attachmentUpload) error {
+	for _, u := range uploads {
+		if err := attachmentStore.Put(u.Name, u.Data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertAttachmentRows はメッセージと同じトランザクションで添付を紐付ける
+func insertAttachmentRows(tx *sqlx.Tx, messageID int64, uploads []attachmentUpload) error {
+	for _, u := range uploads {
+		_, err := tx.Exec("INSERT INTO attachment (message_id, name, filename, content_type, size, created_at)"+
+			" VALUES (?, ?, ?, ?, ?, NOW())",
+			messageID, u.Name, u.Filename, u.ContentType, u.Size)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadAttachments は msgs の添付をまとめて引いて Attachments に入れる
+func loadAttachments(msgs []Message) error {
+	if len(msgs) == 0 {
+		return nil
+	}
+	ids := make([]int64, len(msgs))
+	index := make(map[int64]int, len(msgs))
+	for i, m := range msgs {
+		ids[i] = m.ID
+		index[m.ID] = i
+	}
+	query, args, err := sqlx.In("SELECT * FROM attachment WHERE message_id IN (?) ORDER BY id", ids)
+	if err != nil {
+		return err
+	}
+	attachments := []Attachment{}
+	if err := db.Select(&attachments, query, args...); err != nil {
+		return err
+	}
+	for _, a := range attachments {
+		i := index[a.MessageID]
+		msgs[i].Attachments = append(msgs[i].Attachments, a)
+	}
+	return nil
+}
+
+func getAttachment(id int64) (*Attachment, error) {
+	a := Attachment{}
+	if err := db.Get(&a, "SELECT * FROM attachment WHERE id = ?", id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &a, nil
+}
+
+//request handlers
+
+// getAttachmentFile は添付を配信する。画像以外はブラウザで開かずダウンロードさせる
+func getAttachmentFile(c echo.Context) error {
+	if sessUserID(c) == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	id, err := strconv.ParseInt(c.Param("attachment_id"), 10, 64)
+	if err != nil {
+		return echo.ErrNotFound
+	}
+	a, err := getAttachment(id)
+	if err != nil {
+		return err
+	}
+	if a == nil {
+		return echo.ErrNotFound
+	}
+
+	h := c.Response().Header()
+	// 内容で名前が決まるので、中身は変わらない
+	etag := `"` + a.Name + `"`
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "private, max-age=31536000, immutable")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	blob, err := attachmentStore.Get(a.Name)
+	if err == ErrBlobNotFound {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	disposition := "attachment"
+	if a.IsImage() {
+		disposition = "inline"
+	}
+	h.Set("Content-Disposition", fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`,
+		disposition, asciiFilename(a.Filename), url.PathEscape(a.Filename)))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "default-src 'none'; img-src 'self'; style-src 'unsafe-inline'; sandbox")
+	return c.Blob(http.StatusOK, a.ContentType, blob.Data)
+}
+
+// asciiFilename は filename*= を読めないクライアント向けの名前
+func asciiFilename(name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		if ch < 0x20 || ch >= 0x7f || ch == '"' || ch == '\\' {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// failingBlobStore は Put をすべて失敗させる
+type failingBlobStore struct{ BlobStore }
+
+func (failingBlobStore) Put(name string, data []byte) error {
+	return errors.New("put failed")
+}
+
+func testUpload(content string) attachmentUpload {
+	u := attachmentUpload{Data: []byte(content)}
+	u.Name = fmt.Sprintf("%x.txt", sha1.Sum(u.Data))
+	u.Filename = "note.txt"
+	u.ContentType = attachmentContentTypes[".txt"]
+	u.Size = int64(len(content))
+	return u
+}
+
+func countMessages(t *testing.T, chID int64) int {
+	t.Helper()
+	var n int
+	if err := db.Get(&n, "SELECT COUNT(*) FROM message WHERE channel_id = ?", chID); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// 添付を置けなければメッセージも残さない。置けたらメッセージと添付を一緒に書く
+func TestInsertMessageWithAttachments(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+	chID := 900000000 + time.Now().UnixNano()%1000000
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+	defer db.Exec("DELETE FROM attachment WHERE message_id IN (SELECT id FROM message WHERE channel_id = ?)", chID)
+
+	dir, err := ioutil.TempDir("", "isubata-attachments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s BlobStore) { attachmentStore = s }(attachmentStore)
+
+	m := Message{ChannelID: chID, UserID: 1, Kind: MessageKindText, Content: "log"}
+	attachmentStore = failingBlobStore{}
+	if _, err := insertMessageWithAttachments(m, []attachmentUpload{testUpload("a")}); err == nil {
+		t.Fatal("inserted a message whose attachment could not be stored")
+	}
+	if n := countMessages(t, chID); n != 0 {
+		t.Fatalf("%d messages left after a failed upload", n)
+	}
+
+	attachmentStore = newLocalBlobStore(dir)
+	uploads := []attachmentUpload{testUpload("first"), testUpload("second")}
+	id, err := insertMessageWithAttachments(m, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countMessages(t, chID); n != 1 {
+		t.Fatalf("%d messages, want 1", n)
+	}
+	msgs := []Message{{ID: id}}
+	if err := loadAttachments(msgs); err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs[0].Attachments) != 2 {
+		t.Fatalf("attachments = %+v", msgs[0].Attachments)
+	}
+	for i, a := range msgs[0].Attachments {
+		blob, err := attachmentStore.Get(a.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(blob.Data) != string(uploads[i].Data) {
+			t.Errorf("attachment %d = %q", i, blob.Data)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	// 展開すると巨大になる画像を受け付けないよう、デコードする前に大きさを見る
+	avatarMaxPixels = 4096 * 4096
+	// 元画像もこの大きさまで縮めて保存する
+	avatarMaxSize = 512
+)
+
+// サムネイルの大きさ。user.avatar_icon_<size> に名前を持つ
+var avatarThumbnailSizes = []int{32, 64, 128}
+
+var errAnimatedAvatar = echo.NewHTTPError(http.StatusBadRequest, "アニメーション GIF はアイコンに使えません")
+
+type avatarImage struct {
+	Name string
+	Data []byte
+}
+
+// processedAvatar は検査して作り直したアイコンとサムネイル
+type processedAvatar struct {
+	avatarImage
+	Thumbnails map[int]avatarImage
+}
+
+// processAvatar は中身を実際にデコードして形式を確かめ、メタデータを落とすために作り直す
+// 拡張子は見ずに、デコードできた形式で保存する。GIF は PNG にする
+func processAvatar(data []byte) (*processedAvatar, error) {
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, ErrBadReqeust
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > avatarMaxPixels {
+		return nil, ErrBadReqeust
+	}
+
+	var img image.Image
+	switch format {
+	case "jpeg", "png":
+		img, _, err = image.Decode(bytes.NewReader(data))
+	case "gif":
+		// アニメーションはサムネイルにできないので受け付けない
+		// すべてのフレームを展開すると巨大になりうるので、デコードせずにフレームを数える
+		n, ok := gifFrameCount(data)
+		if !ok {
+			return nil, ErrBadReqeust
+		}
+		if n > 1 {
+			return nil, errAnimatedAvatar
+		}
+		// gif.Decode は最初のフレームだけを展開する。フレームは画面の大きさに収まることも確かめられる
+		img, err = gif.Decode(bytes.NewReader(data))
+	default:
+		return nil, ErrBadReqeust
+	}
+	if err != nil {
+		return nil, ErrBadReqeust
+	}
+
+	return buildAvatar(toRGBA(img), format)
+}
+
+// gifFrameCount は GIF のブロックをたどって画像の数を数える。LZW のデータは読み飛ばす
+// 2枚目が見つかった時点でやめる。途中で切れたり壊れていても、1枚あれば後は gif.Decode に任せる
+func gifFrameCount(data []byte) (int, bool) {
+	if len(data) < 13 {
+		return 0, false
+	}
+	p := 13
+	if data[10]&0x80 != 0 {
+		p += 3 << (uint(data[10]&0x07) + 1)
+	}
+	// サブブロックの並びを 0 の終端まで読み飛ばす
+	skipSubBlocks := func() bool {
+		for p < len(data) {
+			n := int(data[p])
+			p += 1 + n
+			if n == 0 {
+				return true
+			}
+		}
+		return false
+	}
+	frames := 0
+	for p < len(data) {
+		switch data[p] {
+		case 0x21: // 拡張ブロック
+			p += 2
+			if !skipSubBlocks() {
+				return frames, frames > 0
+			}
+		case 0x2c: // 画像
+			frames++
+			if frames > 1 {
+				return frames, true
+			}
+			if p+10 > len(data) {
+				return frames, true
+			}
+			flags := data[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (uint(flags&0x07) + 1)
+			}
+			// LZW の最小コードサイズ
+			p++
+			if !skipSubBlocks() {
+				return frames, true
+			}
+		case 0x3b: // 終端
+			return frames, frames > 0
+		default:
+			return frames, frames > 0
+		}
+	}
+	return frames, frames > 0
+}
+
+// buildAvatar は src を縮めたものとサムネイルを format で作る
+func buildAvatar(src *image.RGBA, format string) (*processedAvatar, error) {
+	w, h := fitWithin(src.Bounds().Dx(), src.Bounds().Dy(), avatarMaxSize)
+	main, err := encodeAvatar(resizeRGBA(src, src.Bounds(), w, h), format)
+	if err != nil {
+		return nil, err
+	}
+	avatar := &processedAvatar{avatarImage: main, Thumbnails: map[int]avatarImage{}}
+	crop := centerSquare(src.Bounds())
+	for _, size := range avatarThumbnailSizes {
+		thumb, err := encodeAvatar(resizeRGBA(src, crop, size, size), format)
+		if err != nil {
+			return nil, err
+		}
+		avatar.Thumbnails[size] = thumb
+	}
+	return avatar, nil
+}
+
+// encodeAvatar は sha1 の名前を付ける。形式はアップロードされたものに合わせる
+func encodeAvatar(img image.Image, format string) (avatarImage, error) {
+	var buf bytes.Buffer
+	ext := ".png"
+	var err error
+	if format == "jpeg" {
+		ext = ".jpg"
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return avatarImage{}, err
+	}
+	return avatarImage{Name: fmt.Sprintf("%x%s", sha1.Sum(buf.Bytes()), ext), Data: buf.Bytes()}, nil
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+func fitWithin(w, h, max int) (int, int) {
+	if w <= max && h <= max {
+		return w, h
+	}
+	if w >= h {
+		return max, maxInt(1, h*max/w)
+	}
+	return maxInt(1, w*max/h), max
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func centerSquare(r image.Rectangle) image.Rectangle {
+	if r.Dx() > r.Dy() {
+		x := r.Min.X + (r.Dx()-r.Dy())/2
+		return image.Rect(x, r.Min.Y, x+r.Dy(), r.Max.Y)
+	}
+	y := r.Min.Y + (r.Dy()-r.Dx())/2
+	return image.Rect(r.Min.X, y, r.Max.X, y+r.Dx())
+}
+
+// resizeRGBA は src の r の範囲を w x h にする
+// 縮小は覆う画素の平均、拡大は最も近い画素になる
+func resizeRGBA(src *image.RGBA, r image.Rectangle, w, h int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*r.Dy()/h
+		y1 := maxInt(y0+1, r.Min.Y+(y+1)*r.Dy()/h)
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*r.Dx()/w
+			x1 := maxInt(x0+1, r.Min.X+(x+1)*r.Dx()/w)
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				i := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					sum[0] += int(src.Pix[i])
+					sum[1] += int(src.Pix[i+1])
+					sum[2] += int(src.Pix[i+2])
+					sum[3] += int(src.Pix[i+3])
+					i += 4
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			j := dst.PixOffset(x, y)
+			for k := 0; k < 4; k++ {
+				dst.Pix[j+k] = uint8(sum[k] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// saveAvatar は BlobStore に置いてから user の参照を差し替える
+func saveAvatar(userID int64, avatar *processedAvatar) error {
+	if err := iconStore.Put(avatar.Name, avatar.Data); err != nil {
+		return err
+	}
+	for _, size := range avatarThumbnailSizes {
+		t := avatar.Thumbnails[size]
+		if err := iconStore.Put(t.Name, t.Data); err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("UPDATE user SET avatar_icon = ?, avatar_icon_32 = ?, avatar_icon_64 = ?, avatar_icon_128 = ? WHERE id = ?",
+		avatar.Name, avatar.Thumbnails[32].Name, avatar.Thumbnails[64].Name, avatar.Thumbnails[128].Name, userID)
+	return err
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	// 初期データの image の最大 id。/initialize はこれより後を消す
+	initialImageMaxID = 1001
+	// Put してから user を UPDATE するまでの間に消さないよう、新しいものは残す
+	defaultAvatarGCGrace = time.Hour
+)
+
+// avatarGCOptions は GC の動かし方
+type avatarGCOptions struct {
+	DryRun bool
+	// 空でなければ消す前にこのディレクトリへ写す
+	ArchiveDir string
+	Grace      time.Duration
+	Now        time.Time
+}
+
+// avatarGCReport は GC の結果。DryRun のときは消すはずだったものを入れる
+type avatarGCReport struct {
+	DryRun        bool      `json:"dry_run"`
+	StartedAt     time.Time `json:"started_at"`
+	Referenced    int       `json:"referenced"`
+	Scanned       int       `json:"scanned"`
+	SkippedRecent int       `json:"skipped_recent"`
+	Removed       []string  `json:"removed"`
+	RemovedBytes  int64     `json:"removed_bytes"`
+	ImageRows     []int64   `json:"image_rows"`
+	ArchiveDir    string    `json:"archive_dir,omitempty"`
+	Errors        []string  `json:"errors"`
+}
+
+func (r *avatarGCReport) fail(format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	log.Println(msg, "IN avatarGC")
+	r.Errors = append(r.Errors, msg)
+}
+
+func (r *avatarGCReport) WriteText(w io.Writer) {
+	mode := "removed"
+	if r.DryRun {
+		mode = "would remove"
+	}
+	fmt.Fprintf(w, "referenced: %d\n", r.Referenced)
+	fmt.Fprintf(w, "scanned: %d (skipped %d newer than grace period)\n", r.Scanned, r.SkippedRecent)
+	fmt.Fprintf(w, "%s: %d blobs, %d bytes\n", mode, len(r.Removed), r.RemovedBytes)
+	for _, name := range r.Removed {
+		fmt.Fprintf(w, "  %s\n", name)
+	}
+	fmt.Fprintf(w, "%s: %d image rows\n", mode, len(r.ImageRows))
+	if r.ArchiveDir != "" {
+		fmt.Fprintf(w, "archived to: %s\n", r.ArchiveDir)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+}
+
+// referencedAvatarNames は user と webhook の投稿から参照されているアイコン名と、初期データの名前を返す
+// 初期データのアイコンは /initialize で user が戻ると再び参照されるので消さない
+func referencedAvatarNames() (map[string]bool, error) {
+	names := []string{}
+	err := db.Select(&names, "SELECT avatar_icon FROM user"+
+		" UNION SELECT avatar_icon_32 FROM user"+
+		" UNION SELECT avatar_icon_64 FROM user"+
+		" UNION SELECT avatar_icon_128 FROM user"+
+		" UNION SELECT sender_icon FROM message WHERE sender_icon <> ''"+
+		" UNION SELECT name FROM image WHERE id <= ? AND name IS NOT NULL", initialImageMaxID)
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{"default.png": true}
+	for _, name := range names {
+		if name != "" {
+			referenced[name] = true
+		}
+	}
+	return referenced, nil
+}
+
+// runAvatarGC は参照されていないアイコンを iconStore と image テーブルから消す
+func runAvatarGC(opts avatarGCOptions) (*avatarGCReport, error) {
+	if opts.Now.IsZero() {
+		opts.Now = time.Now()
+	}
+	report := &avatarGCReport{
+		DryRun:     opts.DryRun,
+		StartedAt:  opts.Now,
+		Removed:    []string{},
+		ImageRows:  []int64{},
+		ArchiveDir: opts.ArchiveDir,
+		Errors:     []string{},
+	}
+	var archive BlobStore
+	if opts.ArchiveDir != "" {
+		archive = newLocalBlobStore(opts.ArchiveDir)
+	}
+
+	// 一覧を取ってから参照を引くので、その間に変わったアイコンは参照されている側に入る
+	blobs, err := iconStore.List()
+	if err != nil {
+		return nil, err
+	}
+	referenced, err := referencedAvatarNames()
+	if err != nil {
+		return nil, err
+	}
+	report.Referenced = len(referenced)
+	report.Scanned = len(blobs)
+
+	sort.Slice(blobs, func(i, j int) bool { return blobs[i].Name < blobs[j].Name })
+	for _, b := range blobs {
+		if referenced[b.Name] {
+			continue
+		}
+		if opts.Now.Sub(b.ModTime) < opts.Grace {
+			report.SkippedRecent++
+			continue
+		}
+		if !opts.DryRun {
+			if archive != nil {
+				blob, err := iconStore.Get(b.Name)
+				if err == ErrBlobNotFound {
+					continue
+				}
+				if err != nil {
+					report.fail("get %s: %v", b.Name, err)
+					continue
+				}
+				if err := archive.Put(b.Name, blob.Data); err != nil {
+					report.fail("archive %s: %v", b.Name, err)
+					continue
+				}
+			}
+			if err := iconStore.Delete(b.Name); err != nil {
+				report.fail("delete %s: %v", b.Name, err)
+				continue
+			}
+		}
+		report.Removed = append(report.Removed, b.Name)
+		report.RemovedBytes += b.Size
+	}
+
+	// iconStore が image テーブルなら上で消えている
+	if s, ok := iconStore.(*mysqlBlobStore); ok && s.table == "image" {
+		return report, nil
+	}
+	if err := collectImageRows(opts, referenced, archive, report); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// collectImageRows は iconStore とは別に残っている image テーブルの行を消す
+func collectImageRows(opts avatarGCOptions, referenced map[string]bool, archive BlobStore, report *avatarGCReport) error {
+	type imageRow struct {
+		ID        int64     `db:"id"`
+		Name      string    `db:"name"`
+		CreatedAt time.Time `db:"created_at"`
+	}
+	rows := []imageRow{}
+	err := db.Select(&rows, "SELECT id, name, created_at FROM image WHERE id > ? AND name IS NOT NULL ORDER BY id",
+		initialImageMaxID)
+	if err != nil {
+		return err
+	}
+	ids := []int64{}
+	for _, row := range rows {
+		if referenced[row.Name] || opts.Now.Sub(row.CreatedAt) < opts.Grace {
+			continue
+		}
+		if !opts.DryRun && archive != nil {
+			var data []byte
+			if err := db.Get(&data, "SELECT data FROM image WHERE id = ?", row.ID); err != nil {
+				report.fail("get image %d: %v", row.ID, err)
+				continue
+			}
+			if err := archive.Put(row.Name, data); err != nil {
+				report.fail("archive image %d: %v", row.ID, err)
+				continue
+			}
+		}
+		ids = append(ids, row.ID)
+	}
+	if len(ids) == 0 || opts.DryRun {
+		report.ImageRows = append(report.ImageRows, ids...)
+		return nil
+	}
+	query, args, err := sqlx.In("DELETE FROM image WHERE id IN (?)", ids)
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec(query, args...); err != nil {
+		return err
+	}
+	report.ImageRows = append(report.ImageRows, ids...)
+	return nil
+}
+
+// runAvatarGCCommand は `isubata gc-avatars` の本体
+func runAvatarGCCommand(args []string) int {
+	fs := flag.NewFlagSet("gc-avatars", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "消さずに対象を表示する")
+	archiveDir := fs.String("archive", "", "消す前にアイコンを写すディレクトリ")
+	grace := fs.Duration("grace", defaultAvatarGCGrace, "これより新しいアイコンは消さない")
+	asJSON := fs.Bool("json", false, "結果を JSON で出力する")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	report, err := runAvatarGC(avatarGCOptions{DryRun: *dryRun, ArchiveDir: *archiveDir, Grace: *grace})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(os.Stdout)
+	}
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// runAvatarGCLoop は ISUBATA_AVATAR_GC_INTERVAL ごとに、スケジューラのリーダーだけが GC する
+func runAvatarGCLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		leader, err := acquireSchedulerLeader()
+		if err != nil {
+			log.Println(err, "IN runAvatarGCLoop")
+			continue
+		}
+		if !leader {
+			continue
+		}
+		report, err := runAvatarGC(avatarGCOptions{
+			ArchiveDir: os.Getenv("ISUBATA_AVATAR_GC_ARCHIVE"),
+			Grace:      defaultAvatarGCGrace,
+		})
+		if err != nil {
+			log.Println(err, "IN runAvatarGCLoop")
+			continue
+		}
+		log.Printf("avatar gc: removed %d blobs (%d bytes), %d image rows",
+			len(report.Removed), report.RemovedBytes, len(report.ImageRows))
+	}
+}
+
+// startAvatarGC は間隔が設定されているときだけ定期 GC を動かす
+func startAvatarGC() {
+	v := os.Getenv("ISUBATA_AVATAR_GC_INTERVAL")
+	if v == "" {
+		return
+	}
+	interval, err := time.ParseDuration(v)
+	if err != nil || interval <= 0 {
+		log.Fatalf("invalid ISUBATA_AVATAR_GC_INTERVAL: %q", v)
+	}
+	go runAvatarGCLoop(interval)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// archiveCheckingStore は消す前にアーカイブへ写されているかを確かめる
+type archiveCheckingStore struct {
+	BlobStore
+	t          *testing.T
+	archiveDir string
+}
+
+func (s archiveCheckingStore) Delete(name string) error {
+	if _, err := os.Stat(filepath.Join(s.archiveDir, name)); err != nil {
+		s.t.Errorf("%s was deleted before it was archived", name)
+	}
+	return s.BlobStore.Delete(name)
+}
+
+func TestRunAvatarGC(t *testing.T) {
+	requireDB(t)
+
+	dir, err := ioutil.TempDir("", "isubata-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	archiveDir := filepath.Join(dir, "archive")
+	defer func(s BlobStore) { iconStore = s }(iconStore)
+	iconStore = archiveCheckingStore{newLocalBlobStore(filepath.Join(dir, "icons")), t, archiveDir}
+
+	prefix := testName("gc")
+	userIcon := prefix + "-user.png"
+	hookIcon := prefix + "-hook.png"
+	orphan := prefix + "-orphan.png"
+	recent := prefix + "-recent.png"
+	orphanRow := prefix + "-row.png"
+
+	userID := insertTestUser(t, prefix, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	if _, err := db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", userIcon, userID); err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO message (channel_id, user_id, content, kind, sender_name, sender_icon, created_at)"+
+		" VALUES (0, 0, 'hook', ?, 'hook', ?, NOW())", MessageKindWebhook, hookIcon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	messageID, _ := res.LastInsertId()
+	defer db.Exec("DELETE FROM message WHERE id = ?", messageID)
+
+	// 初期データの画像。無ければ id = initialImageMaxID で作る
+	var initial string
+	err = db.Get(&initial, "SELECT name FROM image WHERE id <= ? AND name IS NOT NULL ORDER BY id DESC LIMIT 1", initialImageMaxID)
+	if err != nil {
+		initial = prefix + "-initial.png"
+		_, err := db.Exec("INSERT INTO image (id, name, data, created_at) VALUES (?, ?, 'initial', '2017-01-01 00:00:00')",
+			initialImageMaxID, initial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Exec("DELETE FROM image WHERE id = ?", initialImageMaxID)
+	}
+	res, err = db.Exec("INSERT INTO image (name, data, created_at) VALUES (?, 'row-data', '2017-01-01 00:00:00')", orphanRow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rowID, _ := res.LastInsertId()
+	defer db.Exec("DELETE FROM image WHERE id = ?", rowID)
+
+	old := time.Now().Add(-2 * defaultAvatarGCGrace)
+	for _, name := range []string{userIcon, hookIcon, initial, orphan, recent} {
+		if err := iconStore.Put(name, []byte("data-"+name)); err != nil {
+			t.Fatal(err)
+		}
+		if name != recent {
+			if err := os.Chtimes(filepath.Join(dir, "icons", name), old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	opts := avatarGCOptions{Grace: defaultAvatarGCGrace, ArchiveDir: archiveDir}
+
+	// dry-run は何も消さず、消すはずのものを返す
+	opts.DryRun = true
+	dry, err := runAvatarGC(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(dry.Removed) != fmt.Sprint([]string{orphan}) || !containsID(dry.ImageRows, rowID) {
+		t.Fatalf("dry-run: removed %v, image rows %v", dry.Removed, dry.ImageRows)
+	}
+	if dry.SkippedRecent != 1 || len(dry.Errors) != 0 {
+		t.Errorf("dry-run: %+v", dry)
+	}
+	if _, err := iconStore.Get(orphan); err != nil {
+		t.Errorf("dry-run removed a blob: %v", err)
+	}
+	var rows int
+	db.Get(&rows, "SELECT COUNT(*) FROM image WHERE id = ?", rowID)
+	if rows != 1 {
+		t.Error("dry-run removed an image row")
+	}
+	if _, err := os.Stat(archiveDir); !os.IsNotExist(err) {
+		t.Errorf("dry-run wrote the archive: %v", err)
+	}
+
+	opts.DryRun = false
+	report, err := runAvatarGC(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(report.Removed) != fmt.Sprint(dry.Removed) || fmt.Sprint(report.ImageRows) != fmt.Sprint(dry.ImageRows) {
+		t.Errorf("removed %v %v, dry-run reported %v %v", report.Removed, report.ImageRows, dry.Removed, dry.ImageRows)
+	}
+	if _, err := iconStore.Get(orphan); err != ErrBlobNotFound {
+		t.Errorf("orphan: err = %v", err)
+	}
+	for _, name := range []string{userIcon, hookIcon, initial, recent} {
+		if _, err := iconStore.Get(name); err != nil {
+			t.Errorf("%s was removed: %v", name, err)
+		}
+	}
+	db.Get(&rows, "SELECT COUNT(*) FROM image WHERE id = ?", rowID)
+	if rows != 0 {
+		t.Error("unreferenced image row is left")
+	}
+
+	// 消す前に中身を写している
+	for name, want := range map[string]string{orphan: "data-" + orphan, orphanRow: "row-data"} {
+		data, err := ioutil.ReadFile(filepath.Join(archiveDir, name))
+		if err != nil || string(data) != want {
+			t.Errorf("archive %s = %q, err = %v", name, data, err)
+		}
+	}
+}
+
+func containsID(ids []int64, id int64) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
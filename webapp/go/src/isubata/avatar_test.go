@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return img
+}
+
+func testGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		p := image.NewPaletted(image.Rect(0, 0, 40, 30), []color.Color{color.Black, color.White})
+		p.SetColorIndex(i, i, 1)
+		g.Image = append(g.Image, p)
+		g.Delay = append(g.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessAvatarRejectsNonImages(t *testing.T) {
+	for _, data := range []string{
+		"<html><script>alert(1)</script></html>",
+		`<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"></svg>`,
+		"",
+	} {
+		if _, err := processAvatar([]byte(data)); err != ErrBadReqeust {
+			t.Errorf("processAvatar(%q): err = %v", data, err)
+		}
+	}
+}
+
+// 大きさはヘッダだけで判定し、展開はしない
+func TestProcessAvatarRejectsOversizedImage(t *testing.T) {
+	data := testGIF(t, 1)
+	// 論理画面の幅と高さを 5000 x 5000 に書き換える
+	data[6], data[7], data[8], data[9] = 0x88, 0x13, 0x88, 0x13
+	if _, err := processAvatar(data); err != ErrBadReqeust {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestProcessAvatarGIF(t *testing.T) {
+	if _, err := processAvatar(testGIF(t, 3)); err != errAnimatedAvatar {
+		t.Errorf("animated GIF: err = %v", err)
+	}
+
+	avatar, err := processAvatar(testGIF(t, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(avatar.Data)); err != nil || format != "png" {
+		t.Errorf("format = %q, err = %v", format, err)
+	}
+	for _, size := range avatarThumbnailSizes {
+		cfg, err := png.DecodeConfig(bytes.NewReader(avatar.Thumbnails[size].Data))
+		if err != nil || cfg.Width != size || cfg.Height != size {
+			t.Errorf("thumbnail %d: %+v, err = %v", size, cfg, err)
+		}
+	}
+}
+
+func TestProcessAvatarStripsEXIF(t *testing.T) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(600, 300), nil); err != nil {
+		t.Fatal(err)
+	}
+	// SOI の直後に位置情報入りの APP1(Exif) を差し込む
+	payload := []byte("Exif\x00\x00GPS-SECRET-35.6812,139.7671")
+	app1 := append([]byte{0xff, 0xe1, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+	src := buf.Bytes()
+	data := append(append(append([]byte{}, src[:2]...), app1...), src[2:]...)
+	if _, _, err := image.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	avatar, err := processAvatar(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range [][]byte{avatar.Data, avatar.Thumbnails[32].Data, avatar.Thumbnails[128].Data} {
+		if bytes.Contains(d, []byte("Exif")) || bytes.Contains(d, []byte("GPS-SECRET")) {
+			t.Error("metadata was kept")
+		}
+	}
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(avatar.Data))
+	if err != nil || format != "jpeg" || cfg.Width != avatarMaxSize || cfg.Height != avatarMaxSize/2 {
+		t.Errorf("format = %q, %+v, err = %v", format, cfg, err)
+	}
+}
+
+func TestGIFFrameCount(t *testing.T) {
+	for frames := 1; frames <= 3; frames++ {
+		n, ok := gifFrameCount(testGIF(t, frames))
+		want := frames
+		if want > 2 {
+			want = 2
+		}
+		if !ok || n != want {
+			t.Errorf("%d frames: n = %d, ok = %v", frames, n, ok)
+		}
+	}
+	if _, ok := gifFrameCount([]byte("GIF89a")); ok {
+		t.Error("accepted a truncated header")
+	}
+}
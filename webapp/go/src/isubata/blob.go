@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ErrBlobNotFound は Get で名前が見つからなかったときに返す
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore は名前で引くバイナリの置き場所
+// 名前は内容の sha1 から作るので、同じ名前で違う内容を Put することはない
+type BlobStore interface {
+	Put(name string, data []byte) error
+	Get(name string) (*Blob, error)
+	Delete(name string) error
+	// List は置いてあるものをすべて返す。Data は読まない
+	List() ([]Blob, error)
+}
+
+// ISUBATA_BLOB_STORE で選ぶ。複数台で動かすときは mysql か s3 にする
+var (
+	iconStore       = newBlobStore("icons", ICONS_PATH, "image")
+	attachmentStore = newBlobStore("attachments",
+		envOrDefault("ISUBATA_ATTACHMENTS_PATH", "/home/isucon/isubata/webapp/attachments/"), "attachment_blob")
+)
+
+// newBlobStore は用途ごとの置き場所を返す
+// local はディレクトリ、mysql はテーブル、s3 はバケット内の "<kind>/" の下に置く
+func newBlobStore(kind, dir, table string) BlobStore {
+	switch backend := envOrDefault("ISUBATA_BLOB_STORE", "local"); backend {
+	case "local":
+		return newLocalBlobStore(dir)
+	case "mysql":
+		return newMySQLBlobStore(table)
+	case "s3":
+		s, err := newS3BlobStoreFromEnv(kind + "/")
+		if err != nil {
+			log.Fatal(err)
+		}
+		return s
+	default:
+		log.Fatalf("unknown ISUBATA_BLOB_STORE: %q", backend)
+		return nil
+	}
+}
+
+func blobContentType(name string) string {
+	if t := mime.TypeByExtension(filepath.Ext(name)); t != "" {
+		return t
+	}
+	return "application/octet-stream"
+}
+
+type Blob struct {
+	Name    string
+	Data    []byte
+	Size    int64
+	ModTime time.Time
+}
+
+// validBlobName はディレクトリを抜け出す名前を弾く
+func validBlobName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// localBlobStore は1つのディレクトリにファイルとして置く。1台で動かすとき用
+type localBlobStore struct {
+	dir string
+}
+
+func newLocalBlobStore(dir string) *localBlobStore {
+	return &localBlobStore{dir: dir}
+}
+
+func (s *localBlobStore) Put(name string, data []byte) error {
+	if !validBlobName(name) {
+		return ErrBadReqeust
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	// 書きかけのファイルを読まれないよう、一時ファイルに書いてから置き換える
+	tmp, err := ioutil.TempFile(s.dir, ".tmp-"+name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(s.dir, name))
+}
+
+func (s *localBlobStore) Get(name string) (*Blob, error) {
+	if !validBlobName(name) {
+		return nil, ErrBlobNotFound
+	}
+	path := filepath.Join(s.dir, name)
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &Blob{Name: name, Data: data, Size: st.Size(), ModTime: st.ModTime()}, nil
+}
+
+func (s *localBlobStore) Delete(name string) error {
+	if !validBlobName(name) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *localBlobStore) List() ([]Blob, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if os.IsNotExist(err) {
+		return []Blob{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	blobs := make([]Blob, 0, len(infos))
+	for _, fi := range infos {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".tmp-") {
+			continue
+		}
+		blobs = append(blobs, Blob{Name: fi.Name(), Size: fi.Size(), ModTime: fi.ModTime()})
+	}
+	return blobs, nil
+}
+
+// mysqlBlobStore は name, data, created_at を持つテーブルに置く。アバターは image テーブル
+type mysqlBlobStore struct {
+	table string
+}
+
+func newMySQLBlobStore(table string) *mysqlBlobStore {
+	return &mysqlBlobStore{table: table}
+}
+
+func (s *mysqlBlobStore) Put(name string, data []byte) error {
+	if !validBlobName(name) {
+		return ErrBadReqeust
+	}
+	// image の name は UNIQUE ではないので、先に有無を確かめる
+	var cnt int64
+	if err := db.Get(&cnt, fmt.Sprintf("SELECT COUNT(*) FROM %s WHERE name = ?", s.table), name); err != nil {
+		return err
+	}
+	if cnt > 0 {
+		return nil
+	}
+	_, err := db.Exec(fmt.Sprintf("INSERT INTO %s (name, data, created_at) VALUES (?, ?, NOW())", s.table), name, data)
+	if isDuplicateEntry(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *mysqlBlobStore) Get(name string) (*Blob, error) {
+	b := Blob{Name: name}
+	err := db.QueryRow(fmt.Sprintf("SELECT data, created_at FROM %s WHERE name = ? LIMIT 1", s.table), name).
+		Scan(&b.Data, &b.ModTime)
+	if err == sql.ErrNoRows {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	b.Size = int64(len(b.Data))
+	return &b, nil
+}
+
+func (s *mysqlBlobStore) Delete(name string) error {
+	_, err := db.Exec(fmt.Sprintf("DELETE FROM %s WHERE name = ?", s.table), name)
+	return err
+}
+
+func (s *mysqlBlobStore) List() ([]Blob, error) {
+	rows, err := db.Query(fmt.Sprintf("SELECT name, MAX(LENGTH(data)), MAX(created_at) FROM %s"+
+		" WHERE name IS NOT NULL GROUP BY name", s.table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	blobs := []Blob{}
+	for rows.Next() {
+		var b Blob
+		var size sql.NullInt64
+		if err := rows.Scan(&b.Name, &size, &b.ModTime); err != nil {
+			return nil, err
+		}
+		b.Size = size.Int64
+		blobs = append(blobs, b)
+	}
+	return blobs, rows.Err()
+}
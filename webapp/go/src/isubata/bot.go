@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Bot はプロセス内で動く bot。投稿されたメッセージを受け取り、bot ユーザとして返信できる
+type Bot interface {
+	// bot ユーザの name。最初に返信するときにユーザを作る
+	Name() string
+	DisplayName() string
+	// bot 自身や他の bot の投稿、システムメッセージは渡さない
+	OnMessage(bc *BotContext, m Message) error
+}
+
+// BotContext はメッセージが投稿されたチャンネルへの返信口
+type BotContext struct {
+	bot     Bot
+	Channel *ChannelInfo
+}
+
+func (bc *BotContext) Reply(content string) error {
+	return replyAsBot(bc.bot, bc.Channel.ID, content)
+}
+
+var bots []Bot
+
+// registerBot は init で呼ぶ
+func registerBot(b Bot) {
+	bots = append(bots, b)
+}
+
+// ensureBotUser は bot ユーザの id を返す。/initialize で消えても作り直す
+func ensureBotUser(b Bot) (int64, error) {
+	u, err := getUserByName(b.Name())
+	if err != nil {
+		return 0, err
+	}
+	if u != nil {
+		return botUserID(b, u)
+	}
+	// パスワードが空なのでログインはできない
+	res, err := db.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, role, created_at)"+
+		" VALUES (?, '', '', ?, 'default.png', ?, NOW())", b.Name(), b.DisplayName(), RoleBot)
+	if err != nil {
+		if isDuplicateEntry(err) {
+			if u, err = getUserByName(b.Name()); err == nil && u != nil {
+				return botUserID(b, u)
+			}
+		}
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+// botUserID は同じ名前の人のユーザが bot として投稿しないよう、role を確かめる
+func botUserID(b Bot, u *User) (int64, error) {
+	if u.Role != RoleBot {
+		return 0, fmt.Errorf("user %q is not a bot user", b.Name())
+	}
+	return u.ID, nil
+}
+
+func replyAsBot(b Bot, chID int64, content string) error {
+	userID, err := ensureBotUser(b)
+	if err != nil {
+		return err
+	}
+	_, err = addMessageWithKind(chID, userID, MessageKindBot, content)
+	return err
+}
+
+// onMessageAdded は addMessage から呼ばれる。応答を待たせないよう bot と outgoing webhook は別の goroutine で動かす
+// bot や webhook の投稿に反応してループしないよう、人の投稿だけを渡す
+func onMessageAdded(m Message) {
+	if m.Kind != MessageKindText && m.Kind != MessageKindMe {
+		return
+	}
+	go func() {
+		ch, err := getChannelInfo(m.ChannelID)
+		if err != nil || ch == nil || ch.ArchivedAt != nil {
+			return
+		}
+		for _, b := range bots {
+			if err := b.OnMessage(&BotContext{bot: b, Channel: ch}, m); err != nil {
+				log.Printf("bot %s: %v", b.Name(), err)
+			}
+		}
+		if err := enqueueOutgoingWebhooks(ch, m); err != nil {
+			log.Println(err, "IN onMessageAdded")
+		}
+	}()
+}
+
+// isubot は @isubot へのメンションに答える組み込みの bot。/remind や /help の返信にも使う
+type isubotBot struct{}
+
+var isubot Bot = isubotBot{}
+
+func init() {
+	registerBot(isubot)
+}
+
+func (isubotBot) Name() string        { return "isubot" }
+func (isubotBot) DisplayName() string { return "isubot" }
+
+func (isubotBot) OnMessage(bc *BotContext, m Message) error {
+	mention := "@" + isubot.Name()
+	if !strings.Contains(m.Content, mention) {
+		return nil
+	}
+	switch text := strings.TrimSpace(strings.Replace(m.Content, mention, "", 1)); text {
+	case "ping":
+		return bc.Reply("pong")
+	case "help", "":
+		return bc.Reply(slashCommandHelp())
+	}
+	return nil
+}
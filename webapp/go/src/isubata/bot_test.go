@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+type testBot struct{ name string }
+
+func (b testBot) Name() string                              { return b.name }
+func (b testBot) DisplayName() string                       { return b.name }
+func (b testBot) OnMessage(bc *BotContext, m Message) error { return nil }
+
+func TestReservedUserName(t *testing.T) {
+	cases := map[string]bool{
+		"isubot":         true,
+		"IsuBot":         true,
+		"webhook-abc":    true,
+		"Webhook-abc":    true,
+		"deleted-12":     true,
+		"isubot2":        false,
+		"my-webhook-abc": false,
+		"alice":          false,
+	}
+	for name, want := range cases {
+		if got := reservedUserName(name); got != want {
+			t.Errorf("reservedUserName(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+// bot と同じ名前の人のユーザがいても、そのユーザとしては投稿しない
+func TestEnsureBotUserRequiresBotRole(t *testing.T) {
+	requireDB(t)
+
+	squatted := testBot{fmt.Sprintf("squat%d", time.Now().UnixNano()%1000000000)}
+	_, err := db.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
+		" VALUES (?, '', '', ?, 'default.png', NOW())", squatted.name, squatted.name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM user WHERE name = ?", squatted.name)
+	if _, err := ensureBotUser(squatted); err == nil {
+		t.Error("ensureBotUser accepted a member user")
+	}
+
+	b := testBot{squatted.name + "-bot"}
+	defer db.Exec("DELETE FROM user WHERE name = ?", b.name)
+	id, err := ensureBotUser(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ensureBotUser(b)
+	if err != nil || again != id {
+		t.Errorf("second call: id = %d, err = %v, want %d", again, err, id)
+	}
+}
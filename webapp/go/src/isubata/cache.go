@@ -12,12 +12,10 @@ import (
 	"github.com/gomodule/redigo/redis"
 )
 
-const (
-	redisHost = "127.0.0.1"
-	redisPort = "6379"
-)
-
 var (
+	redisHost = envOrDefault("ISUBATA_REDIS_HOST", "127.0.0.1")
+	redisPort = envOrDefault("ISUBATA_REDIS_PORT", "6379")
+
 	// 取得しようとしてるキーに対して、オペレーションが違うときのエラー
 	WrongTypeError = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 )
@@ -104,6 +102,30 @@ func (r *Redisful) SetNXDataToCache(key string, v interface{}) error {
 	return nil
 }
 
+// SETEXは有効期限(秒)付きで上書き
+func (r *Redisful) SetDataToCacheWithExpire(key string, v interface{}, seconds int) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = r.Conn.Do("SETEX", key, seconds, data)
+	if err != nil {
+		if err.Error() == WrongTypeError.Error() {
+			log.Fatal(err)
+		}
+		return err
+	}
+	return nil
+}
+
+func (r *Redisful) DeleteDataInCache(key string) error {
+	_, err := r.Conn.Do("DEL", key)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
 func (r *Redisful) IncrementDataInCache(key string) error {
 	_, err := r.Conn.Do("INCR", key)
 	if err != nil {
@@ -233,6 +255,35 @@ func (r *Redisful) RemoveHashFromCache(key, field string) error {
 	return nil
 }
 
+// pattern に一致するフィールドを HSCAN で探して消す
+func (r *Redisful) RemoveHashFieldsByPattern(key, pattern string) error {
+	cursor := 0
+	for {
+		vals, err := redis.Values(r.Conn.Do("HSCAN", key, cursor, "MATCH", pattern, "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.Int(vals[0], nil)
+		kvs, err := redis.Strings(vals[1], nil)
+		if err != nil {
+			return err
+		}
+		// フィールドと値が交互に並んでいる
+		args := []interface{}{key}
+		for i := 0; i < len(kvs); i += 2 {
+			args = append(args, kvs[i])
+		}
+		if len(args) > 1 {
+			if _, err := r.Conn.Do("HDEL", args...); err != nil {
+				return err
+			}
+		}
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
 // 入力された順
 func (r *Redisful) GetAllHashFromCache(key string) ([]byte, error) {
 	strs, err := redis.Strings(r.Conn.Do("HVALS", key))
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -10,10 +11,21 @@ import (
 
 func queryChannels() ([]int64, error) {
 	res := []int64{}
-	err := db.Select(&res, "SELECT id FROM channel")
+	err := db.Select(&res, "SELECT id FROM channel WHERE archived_at IS NULL")
 	return res, err
 }
 
+func getChannelInfo(chID int64) (*ChannelInfo, error) {
+	ch := ChannelInfo{}
+	if err := db.Get(&ch, "SELECT * FROM channel WHERE id = ?", chID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &ch, nil
+}
+
 func getChannel(c echo.Context) error {
 	user, err := ensureLogin(c)
 	if user == nil {
@@ -23,24 +35,41 @@ func getChannel(c echo.Context) error {
 	if err != nil {
 		return err
 	}
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	sidebar, err := querySidebar(user.ID)
 	if err != nil {
 		return err
 	}
 
+	ch, err := getChannelInfo(int64(cID))
+	if err != nil {
+		return err
+	}
 	var desc string
-	for _, ch := range channels {
-		if ch.ID == int64(cID) {
-			desc = ch.Description
-			break
+	var uc *UserChannel
+	pins := []map[string]interface{}{}
+	if ch != nil {
+		desc = ch.Description
+		if uc, err = getUserChannel(user.ID, ch); err != nil {
+			return err
+		}
+		msgs, err := queryPinnedMessages(ch.ID)
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			pins = append(pins, jsonifyMessageWithUser(m))
 		}
 	}
 	return c.Render(http.StatusOK, "channel", map[string]interface{}{
 		"ChannelID":   cID,
-		"Channels":    channels,
+		"Sidebar":     sidebar,
 		"User":        user,
 		"Description": desc,
+		"Archived":    ch != nil && ch.ArchivedAt != nil,
+		"CanManage":   ch != nil && canManageChannel(user, ch),
+		"UserChannel": uc,
+		"Pins":        pins,
+		"CanPin":      ch != nil && requireChannelPermission(user, ch, PermPostMessage) == nil,
 	})
 }
 
@@ -94,6 +123,9 @@ func getHistory(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := loadAttachments(messages); err != nil {
+		return err
+	}
 
 	mjson := make([]map[string]interface{}, 0)
 	for i := len(messages) - 1; i >= 0; i-- {
@@ -102,19 +134,31 @@ func getHistory(c echo.Context) error {
 		mjson = append(mjson, r)
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	// 表示した中で最新のメッセージまで既読にする
+	if len(messages) > 0 {
+		if err := advanceHaveRead(user.ID, map[int64]int64{chID: messages[0].ID}); err != nil {
+			return err
+		}
+	}
+
+	sidebar, err := querySidebar(user.ID)
+	if err != nil {
+		return err
+	}
+
+	ch, err := getChannelInfo(chID)
 	if err != nil {
 		return err
 	}
 
 	return c.Render(http.StatusOK, "history", map[string]interface{}{
 		"ChannelID": chID,
-		"Channels":  channels,
+		"Sidebar":   sidebar,
 		"Messages":  mjson,
 		"MaxPage":   maxPage,
 		"Page":      page,
 		"User":      user,
+		"Archived":  ch != nil && ch.ArchivedAt != nil,
 	})
 }
 
@@ -124,15 +168,14 @@ func getAddChannel(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	sidebar, err := querySidebar(self.ID)
 	if err != nil {
 		return err
 	}
 
 	return c.Render(http.StatusOK, "add_channel", map[string]interface{}{
 		"ChannelID": 0,
-		"Channels":  channels,
+		"Sidebar":   sidebar,
 		"User":      self,
 	})
 }
@@ -142,6 +185,9 @@ func postAddChannel(c echo.Context) error {
 	if self == nil {
 		return err
 	}
+	if err := requirePermission(self, PermCreateChannel); err != nil {
+		return err
+	}
 
 	name := c.FormValue("name")
 	desc := c.FormValue("description")
@@ -150,12 +196,194 @@ func postAddChannel(c echo.Context) error {
 	}
 
 	res, err := db.Exec(
-		"INSERT INTO channel (name, description, updated_at, created_at) VALUES (?, ?, NOW(), NOW())",
-		name, desc)
+		"INSERT INTO channel (name, description, created_by, updated_at, created_at) VALUES (?, ?, ?, NOW(), NOW())",
+		name, desc, self.ID)
 	if err != nil {
 		return err
 	}
 	lastID, _ := res.LastInsertId()
+	invalidateAllSidebars()
 	return c.Redirect(http.StatusSeeOther,
 		fmt.Sprintf("/channel/%v", lastID))
 }
+
+// canManageChannel は作成者本人か、全チャンネルを管理できるユーザなら true
+func canManageChannel(u *User, ch *ChannelInfo) bool {
+	if u.Can(PermManageAnyChannel) {
+		return true
+	}
+	return ch.CreatedBy != 0 && ch.CreatedBy == u.ID && u.Can(PermManageOwnChannel)
+}
+
+// ensureChannelManager は :channel_id のチャンネルを管理できるか確かめて返す
+func ensureChannelManager(c echo.Context) (*User, *ChannelInfo, error) {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return nil, nil, err
+	}
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return nil, nil, ErrBadReqeust
+	}
+	ch, err := getChannelInfo(chID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ch == nil {
+		return nil, nil, echo.ErrNotFound
+	}
+	if !canManageChannel(self, ch) {
+		return nil, nil, echo.ErrForbidden
+	}
+	return self, ch, nil
+}
+
+func setChannelArchived(chID int64, archived bool) error {
+	var err error
+	if archived {
+		_, err = db.Exec("UPDATE channel SET archived_at = NOW(), updated_at = NOW() WHERE id = ? AND archived_at IS NULL", chID)
+	} else {
+		_, err = db.Exec("UPDATE channel SET archived_at = NULL, updated_at = NOW() WHERE id = ?", chID)
+	}
+	if err != nil {
+		return err
+	}
+	invalidateAllSidebars()
+	return nil
+}
+
+// deleteChannel はメッセージと既読位置、ピン留めや保存ごとチャンネルを消す
+func deleteChannel(chID int64) error {
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec("UPDATE incoming_webhook SET revoked_at = NOW() WHERE channel_id = ? AND revoked_at IS NULL", chID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE outgoing_webhook SET revoked_at = NOW() WHERE channel_id = ? AND revoked_at IS NULL", chID)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM scheduled_message WHERE channel_id = ?", chID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM pinned_message WHERE channel_id = ?", chID); err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE s FROM saved_message AS s INNER JOIN message AS m ON m.id = s.message_id"+
+		" WHERE m.channel_id = ?", chID)
+	if err != nil {
+		return err
+	}
+	// 添付の中身は同じ内容の別の添付と共有していることがあるので BlobStore には残す
+	_, err = tx.Exec("DELETE a FROM attachment AS a INNER JOIN message AS m ON m.id = a.message_id"+
+		" WHERE m.channel_id = ?", chID)
+	if err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM message WHERE channel_id = ?", chID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM haveread WHERE channel_id = ?", chID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM user_channel WHERE channel_id = ?", chID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM channel WHERE id = ?", chID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	invalidateAllSidebars()
+
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	if err = r.DeleteDataInCache(makeMessageCountKey(chID)); err != nil {
+		return err
+	}
+	// フィールドは "<user_id>-<channel_id>"
+	return r.RemoveHashFieldsByPattern(HAVE_READ_KEY, fmt.Sprintf("*-%d", chID))
+}
+
+func getEditChannel(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+	return renderEditChannel(c, self, ch, nil)
+}
+
+func postEditChannel(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+
+	name := c.FormValue("name")
+	desc := c.FormValue("description")
+	if name == "" || desc == "" {
+		return ErrBadReqeust
+	}
+
+	if err := updateChannel(ch.ID, name, desc); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", ch.ID))
+}
+
+// updateChannel は名前と説明を変える。サイドバーに名前が出るので全員のキャッシュを捨てる
+func updateChannel(chID int64, name, desc string) error {
+	_, err := db.Exec("UPDATE channel SET name = ?, description = ?, updated_at = NOW() WHERE id = ?",
+		name, desc, chID)
+	if err != nil {
+		return err
+	}
+	invalidateAllSidebars()
+	return nil
+}
+
+func postArchiveChannel(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+	if err := setChannelArchived(ch.ID, true); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", ch.ID))
+}
+
+func postUnarchiveChannel(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+	if err := setChannelArchived(ch.ID, false); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v", ch.ID))
+}
+
+func postDeleteChannel(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+	// 名前の打ち間違いで消さないよう確認させる
+	if c.FormValue("confirm") != ch.Name {
+		return ErrBadReqeust
+	}
+	if err := deleteChannel(ch.ID); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/")
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func sidebarHasChannel(t *testing.T, userID, chID int64) bool {
+	t.Helper()
+	sidebar, err := querySidebar(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, g := range sidebar.Groups {
+		for _, ch := range g.Channels {
+			if ch.ID == chID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestArchivedChannel(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("archive")
+	ownerID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", ownerID)
+	otherID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", otherID)
+	chID := insertTestChannel(t, name, ownerID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+	if _, err := addMessage(chID, ownerID, "before archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	e, app := newTestApp(t)
+	defer app.Close()
+	e.POST("/channel/:channel_id/archive", postArchiveChannel)
+	e.POST("/message", postMessage)
+	e.GET("/fetch", fetchUnread)
+	owner := newTestClient(t, app, ownerID)
+	other := newTestClient(t, app, otherID)
+	post := func(client *http.Client, path string, form url.Values) int {
+		res, err := client.PostForm(app.URL+path, form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	archivePath := fmt.Sprintf("/channel/%d/archive", chID)
+	messageForm := url.Values{"channel_id": {fmt.Sprint(chID)}, "message": {"hello"}}
+
+	if !sidebarHasChannel(t, ownerID, chID) {
+		t.Fatal("channel is not in the sidebar")
+	}
+	if status := post(other, archivePath, nil); status != http.StatusForbidden {
+		t.Errorf("non-creator archive: status %d", status)
+	}
+	if status := post(owner, archivePath, nil); status != http.StatusSeeOther {
+		t.Fatalf("archive: status %d", status)
+	}
+
+	if status := post(owner, "/message", messageForm); status != http.StatusForbidden {
+		t.Errorf("post to archived channel: status %d", status)
+	}
+	var cnt int
+	db.Get(&cnt, "SELECT COUNT(*) FROM message WHERE channel_id = ?", chID)
+	if cnt != 1 {
+		t.Errorf("messages = %d", cnt)
+	}
+	if sidebarHasChannel(t, ownerID, chID) {
+		t.Error("archived channel is in the sidebar")
+	}
+
+	res, err := owner.Get(app.URL + "/fetch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	var unread []struct {
+		ChannelID int64 `json:"channel_id"`
+	}
+	if err := json.Unmarshal(body, &unread); err != nil {
+		t.Fatalf("fetch: %v, %s", err, body)
+	}
+	for _, u := range unread {
+		if u.ChannelID == chID {
+			t.Error("archived channel is in /fetch")
+		}
+	}
+}
+
+func TestDeleteChannel(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("delete")
+	ownerID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", ownerID)
+	otherID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", otherID)
+	chID := insertTestChannel(t, name, ownerID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+	defer db.Exec("DELETE FROM haveread WHERE channel_id = ?", chID)
+
+	mID, err := addMessage(chID, ownerID, "消えるメッセージ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setHaveRead(HaveRead{UserID: otherID, ChannelID: chID, MessageID: mID}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO haveread (user_id, channel_id, message_id, updated_at, created_at) VALUES (?, ?, ?, NOW(), NOW())",
+		otherID, chID, mID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt, err := getMessageCountFromCache(chID); err != nil || cnt != 1 {
+		t.Fatalf("message count = %d, err = %v", cnt, err)
+	}
+
+	e, app := newTestApp(t)
+	defer app.Close()
+	e.POST("/channel/:channel_id/delete", postDeleteChannel)
+	path := fmt.Sprintf("/channel/%d/delete", chID)
+	form := url.Values{"confirm": {name}}
+	for _, tc := range []struct {
+		userID int64
+		form   url.Values
+		want   int
+	}{
+		{otherID, form, http.StatusForbidden},
+		{ownerID, url.Values{"confirm": {"wrong"}}, http.StatusBadRequest},
+		{ownerID, form, http.StatusSeeOther},
+	} {
+		res, err := newTestClient(t, app, tc.userID).PostForm(app.URL+path, tc.form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != tc.want {
+			t.Fatalf("user %d: status %d, want %d", tc.userID, res.StatusCode, tc.want)
+		}
+	}
+
+	for _, q := range []string{
+		"SELECT COUNT(*) FROM channel WHERE id = ?",
+		"SELECT COUNT(*) FROM message WHERE channel_id = ?",
+		"SELECT COUNT(*) FROM haveread WHERE channel_id = ?",
+	} {
+		var cnt int
+		if err := db.Get(&cnt, q, chID); err != nil {
+			t.Fatal(err)
+		}
+		if cnt != 0 {
+			t.Errorf("%s: %d rows left", q, cnt)
+		}
+	}
+	if _, err := getMessageCountFromCache(chID); err != redis.ErrNil {
+		t.Errorf("message count is left: err = %v", err)
+	}
+	if _, err := getHaveRead(otherID, chID); err != redis.ErrNil {
+		t.Errorf("haveread field is left: err = %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+// CommandContext はコマンドを実行したユーザとチャンネル
+type CommandContext struct {
+	User    *User
+	Channel *ChannelInfo
+	// コマンド名より後ろ。前後の空白は除く
+	Args string
+}
+
+type SlashCommand struct {
+	Name  string
+	Usage string
+	Run   func(cc *CommandContext) error
+}
+
+var slashCommands = map[string]SlashCommand{}
+
+// registerSlashCommand は init で呼ぶ。同じ名前は後から登録したものが勝つ
+func registerSlashCommand(cmd SlashCommand) {
+	slashCommands[cmd.Name] = cmd
+}
+
+func init() {
+	registerSlashCommand(SlashCommand{Name: "me", Usage: "/me <動作>", Run: runMeCommand})
+	registerSlashCommand(SlashCommand{Name: "topic", Usage: "/topic <説明>", Run: runTopicCommand})
+	registerSlashCommand(SlashCommand{Name: "invite", Usage: "/invite @<ユーザ名>", Run: runInviteCommand})
+	registerSlashCommand(SlashCommand{Name: "remind", Usage: "/remind <30m, 2h など> <内容>", Run: runRemindCommand})
+	registerSlashCommand(SlashCommand{Name: "help", Usage: "/help", Run: runHelpCommand})
+}
+
+// "//" で始めると "/" で始まる普通のメッセージとして投稿できる
+func isSlashCommand(message string) bool {
+	return strings.HasPrefix(message, "/") && !strings.HasPrefix(message, "//")
+}
+
+func unescapeSlash(message string) string {
+	if strings.HasPrefix(message, "//") {
+		return message[1:]
+	}
+	return message
+}
+
+func commandError(format string, a ...interface{}) error {
+	return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf(format, a...))
+}
+
+// runSlashCommand は投稿者の権限で実行する
+func runSlashCommand(user *User, ch *ChannelInfo, message string) error {
+	name, args := message[1:], ""
+	if i := strings.IndexAny(name, " \t\n"); i >= 0 {
+		name, args = name[:i], strings.TrimSpace(name[i+1:])
+	}
+	cmd, ok := slashCommands[strings.ToLower(name)]
+	if !ok {
+		return commandError("unknown command: /%s", name)
+	}
+	return cmd.Run(&CommandContext{User: user, Channel: ch, Args: args})
+}
+
+func runMeCommand(cc *CommandContext) error {
+	if cc.Args == "" {
+		return commandError("usage: /me <動作>")
+	}
+	_, err := addMessageWithKind(cc.Channel.ID, cc.User.ID, MessageKindMe, cc.Args)
+	return err
+}
+
+// /topic はチャンネルの編集と同じく、作成者か管理者だけが使える
+func runTopicCommand(cc *CommandContext) error {
+	if cc.Args == "" {
+		return commandError("usage: /topic <説明>")
+	}
+	if !canManageChannel(cc.User, cc.Channel) {
+		return echo.ErrForbidden
+	}
+	if err := updateChannel(cc.Channel.ID, cc.Channel.Name, cc.Args); err != nil {
+		return err
+	}
+	_, err := addMessageWithKind(cc.Channel.ID, cc.User.ID, MessageKindSystem,
+		fmt.Sprintf("%s がトピックを変更しました: %s", cc.User.DisplayName, cc.Args))
+	return err
+}
+
+// チャンネルは全員に公開されているので、/invite は相手へのメンションだけ行う
+// 相手のミュートなどの設定は本人のものなので変えない
+func runInviteCommand(cc *CommandContext) error {
+	name := strings.TrimPrefix(cc.Args, "@")
+	if name == "" || strings.ContainsAny(name, " \t\n") {
+		return commandError("usage: /invite @<ユーザ名>")
+	}
+	other, err := getUserByName(name)
+	if err != nil {
+		return err
+	}
+	if other == nil {
+		return commandError("no such user: %s", name)
+	}
+	_, err = addMessageWithKind(cc.Channel.ID, cc.User.ID, MessageKindSystem,
+		fmt.Sprintf("%s が @%s を招待しました", cc.User.DisplayName, other.Name))
+	return err
+}
+
+// /remind は時間になると isubot がこのチャンネルでメンションする
+func runRemindCommand(cc *CommandContext) error {
+	parts := strings.SplitN(cc.Args, " ", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+		return commandError("usage: /remind <30m, 2h など> <内容>")
+	}
+	d, err := time.ParseDuration(parts[0])
+	if err != nil || d <= 0 || d > maxScheduleAhead {
+		return commandError("invalid duration: %s", parts[0])
+	}
+	content := strings.TrimSpace(parts[1])
+	if utf8.RuneCountInString(content) > maxScheduledContent {
+		return commandError("too long")
+	}
+	return insertScheduledMessage(ScheduledMessage{
+		Kind:      ScheduledKindReminder,
+		UserID:    cc.User.ID,
+		ChannelID: cc.Channel.ID,
+		Content:   content,
+		DeliverAt: time.Now().Add(d),
+	})
+}
+
+func runHelpCommand(cc *CommandContext) error {
+	return replyAsBot(isubot, cc.Channel.ID, "@"+cc.User.Name+" "+slashCommandHelp())
+}
+
+func slashCommandHelp() string {
+	usages := make([]string, 0, len(slashCommands))
+	for _, cmd := range slashCommands {
+		usages = append(usages, cmd.Usage)
+	}
+	sort.Strings(usages)
+	return "使えるコマンド: " + strings.Join(usages, ", ")
+}
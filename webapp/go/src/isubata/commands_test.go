@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func TestTopicCommandRequiresChannelManager(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("topic")
+	ownerID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", ownerID)
+	otherID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", otherID)
+	chID := insertTestChannel(t, name, ownerID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+
+	owner, _ := getUser(ownerID)
+	other, _ := getUser(otherID)
+	ch, _ := getChannelInfo(chID)
+	if err := runSlashCommand(other, ch, "/topic hijacked"); err != echo.ErrForbidden {
+		t.Errorf("non-creator: err = %v", err)
+	}
+	ch, _ = getChannelInfo(chID)
+	if ch.Description == "hijacked" {
+		t.Error("non-creator changed the topic")
+	}
+
+	if err := runSlashCommand(owner, ch, "/topic new topic"); err != nil {
+		t.Fatal(err)
+	}
+	ch, _ = getChannelInfo(chID)
+	if ch.Description != "new topic" || ch.Name != name {
+		t.Errorf("channel = %+v", ch)
+	}
+}
+
+// /invite は相手のミュートを解除しない
+func TestInviteCommandKeepsPreferences(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("invite")
+	selfID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", selfID)
+	otherID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", otherID)
+	chID := insertTestChannel(t, name, selfID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+	_, err := db.Exec("INSERT INTO user_channel (user_id, channel_id, muted, updated_at) VALUES (?, ?, 1, NOW())", otherID, chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM user_channel WHERE channel_id = ?", chID)
+
+	self, _ := getUser(selfID)
+	ch, _ := getChannelInfo(chID)
+	if err := runSlashCommand(self, ch, "/invite @"+name+"x"); err != nil {
+		t.Fatal(err)
+	}
+	var muted bool
+	if err := db.Get(&muted, "SELECT muted FROM user_channel WHERE user_id = ? AND channel_id = ?", otherID, chID); err != nil {
+		t.Fatal(err)
+	}
+	if !muted {
+		t.Error("invite unmuted the channel")
+	}
+	var content string
+	db.Get(&content, "SELECT content FROM message WHERE channel_id = ? ORDER BY id DESC LIMIT 1", chID)
+	if content != name+" が @"+name+"x を招待しました" {
+		t.Errorf("message = %q", content)
+	}
+}
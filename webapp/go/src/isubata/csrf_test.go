@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+)
+
+func newCSRFTestApp() *echo.Echo {
+	e := echo.New()
+	e.Use(csrfMiddleware(false))
+	e.GET("/form", func(c echo.Context) error { return c.String(http.StatusOK, csrfToken(c)) })
+	ok := func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }
+	e.POST("/message", ok)
+	e.POST("/hooks/:token", ok)
+	e.POST("/channel/:channel_id/hooks/:token", ok)
+	return e
+}
+
+func TestCSRFMiddleware(t *testing.T) {
+	if disabled := os.Getenv("ISUBATA_CSRF_DISABLE"); disabled != "" {
+		defer os.Setenv("ISUBATA_CSRF_DISABLE", disabled)
+		os.Unsetenv("ISUBATA_CSRF_DISABLE")
+	}
+	e := newCSRFTestApp()
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/form", nil))
+	token := rec.Body.String()
+	if rec.Code != http.StatusOK || token == "" {
+		t.Fatalf("GET: status %d, token %q", rec.Code, token)
+	}
+	cookie := &http.Cookie{Name: "_csrf", Value: token}
+
+	post := func(path, contentType, body string, header map[string]string) int {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		if contentType != "" {
+			req.Header.Set(echo.HeaderContentType, contentType)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		req.AddCookie(cookie)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	form := echo.MIMEApplicationForm
+	withToken := url.Values{"message": {"hi"}, "_csrf": {token}}.Encode()
+	withoutToken := url.Values{"message": {"hi"}}.Encode()
+	wrongToken := url.Values{"message": {"hi"}, "_csrf": {"wrong-" + token}}.Encode()
+
+	cases := []struct {
+		name        string
+		path        string
+		contentType string
+		body        string
+		header      map[string]string
+		want        int
+	}{
+		{"valid token", "/message", form, withToken, nil, http.StatusNoContent},
+		{"no token", "/message", form, withoutToken, nil, http.StatusForbidden},
+		{"wrong token", "/message", form, wrongToken, nil, http.StatusForbidden},
+		// クロスサイトのフォームは enctype="text/plain" でも送れる
+		{"text/plain", "/message", "text/plain", "message=hi", nil, http.StatusForbidden},
+		{"no content type", "/message", "", withoutToken, nil, http.StatusForbidden},
+		{"multipart", "/message", "multipart/form-data; boundary=x", "--x--\r\n", nil, http.StatusForbidden},
+		{"basic auth", "/message", form, withoutToken, map[string]string{"Authorization": "Basic dXNlcjpwYXNz"}, http.StatusForbidden},
+		{"hooks elsewhere in the path", "/channel/1/hooks/abc", form, withoutToken, nil, http.StatusForbidden},
+		// 以下だけが検査されない
+		{"bearer", "/message", form, withoutToken, map[string]string{"Authorization": "Bearer abc"}, http.StatusNoContent},
+		{"json", "/message", "application/json; charset=utf-8", `{"message":"hi"}`, nil, http.StatusNoContent},
+		{"incoming webhook", "/hooks/abc", form, withoutToken, nil, http.StatusNoContent},
+	}
+	for _, c := range cases {
+		if got := post(c.path, c.contentType, c.body, c.header); got != c.want {
+			t.Errorf("%s: status %d, want %d", c.name, got, c.want)
+		}
+	}
+}
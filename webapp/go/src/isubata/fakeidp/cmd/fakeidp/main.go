@@ -0,0 +1,34 @@
+// 手元で OIDC ログインを試すための IdP
+//
+//	go run isubata/fakeidp/cmd/fakeidp -addr 127.0.0.1:5050
+//	ISUBATA_OIDC_ISSUER=http://127.0.0.1:5050 ISUBATA_OIDC_CLIENT_ID=isubata \
+//	ISUBATA_OIDC_CLIENT_SECRET=secret ISUBATA_OIDC_REDIRECT_URL=http://localhost/login/oidc/callback ./isubata
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"isubata/fakeidp"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5050", "listen address")
+	clientID := flag.String("client-id", "isubata", "client id")
+	clientSecret := flag.String("client-secret", "secret", "client secret")
+	subject := flag.String("sub", "fake-subject-1", "subject of the signed-in user")
+	username := flag.String("username", "fakeuser", "preferred_username of the signed-in user")
+	flag.Parse()
+
+	p, err := fakeidp.New(*clientID, *clientSecret)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p.Issuer = "http://" + *addr
+	p.User.Subject = *subject
+	p.User.PreferredUsername = *username
+
+	log.Printf("fake idp listening on %s", p.Issuer)
+	log.Fatal(http.ListenAndServe(*addr, p))
+}
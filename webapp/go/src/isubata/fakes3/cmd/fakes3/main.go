@@ -0,0 +1,25 @@
+// 手元で ISUBATA_BLOB_STORE=s3 を試すための S3 互換ストレージ(中身はメモリ上だけ)
+//
+//	go run isubata/fakes3/cmd/fakes3 -addr 127.0.0.1:9000
+//	ISUBATA_BLOB_STORE=s3 ISUBATA_S3_ENDPOINT=http://127.0.0.1:9000 ISUBATA_S3_BUCKET=isubata \
+//	ISUBATA_S3_ACCESS_KEY=isubata ISUBATA_S3_SECRET_KEY=secret ./isubata
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"isubata/fakes3"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:9000", "listen address")
+	accessKey := flag.String("access-key", "isubata", "access key")
+	secretKey := flag.String("secret-key", "secret", "secret key")
+	flag.Parse()
+
+	s := fakes3.New(*accessKey, *secretKey)
+	log.Printf("fake s3 listening on http://%s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, s))
+}
@@ -0,0 +1,293 @@
+// Package fakes3 はテストと手元での動作確認用の S3 互換ストレージ
+//
+// path-style の PUT, GET, HEAD, DELETE と ListObjectsV2 だけをメモリ上で扱い、
+// Signature V4 の署名を検証する。httptest.NewServer(s) で起動し、
+// ISUBATA_S3_ENDPOINT にそのURLを入れて使う。バケットは最初の PUT で作られる。
+package fakes3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type object struct {
+	data        []byte
+	contentType string
+	modTime     time.Time
+}
+
+type Server struct {
+	AccessKey string
+	SecretKey string
+	// テストで時刻を固定できるようにする
+	Now func() time.Time
+	// ListObjectsV2 の1ページの件数。リクエストの max-keys の方が小さければそちらを使う
+	MaxKeys int
+
+	mu      sync.Mutex
+	buckets map[string]map[string]object
+}
+
+func New(accessKey, secretKey string) *Server {
+	return &Server{
+		AccessKey: accessKey,
+		SecretKey: secretKey,
+		Now:       time.Now,
+		MaxKeys:   1000,
+		buckets:   map[string]map[string]object{},
+	}
+}
+
+// Keys はテストで中身を確かめるためにバケット内のキーを返す
+func (s *Server) Keys(bucket string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := []string{}
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code></Error>", code)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if !s.verify(r, body) {
+		writeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	if bucket == "" {
+		writeError(w, http.StatusBadRequest, "InvalidBucketName")
+		return
+	}
+	if len(parts) == 1 || parts[1] == "" {
+		if r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2" {
+			s.serveList(w, bucket, r.URL.Query())
+			return
+		}
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	key := parts[1]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		if s.buckets[bucket] == nil {
+			s.buckets[bucket] = map[string]object{}
+		}
+		s.buckets[bucket][key] = object{data: body, contentType: r.Header.Get("Content-Type"), modTime: s.Now()}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		obj, ok := s.buckets[bucket][key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Type", obj.contentType)
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, sha256.Sum256(obj.data)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.Write(obj.data)
+		}
+	case http.MethodDelete:
+		delete(s.buckets[bucket], key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+type listEntry struct {
+	Key          string `xml:"Key"`
+	Size         int    `xml:"Size"`
+	LastModified string `xml:"LastModified"`
+}
+
+type listResult struct {
+	XMLName               xml.Name    `xml:"ListBucketResult"`
+	Name                  string      `xml:"Name"`
+	Prefix                string      `xml:"Prefix"`
+	KeyCount              int         `xml:"KeyCount"`
+	MaxKeys               int         `xml:"MaxKeys"`
+	Contents              []listEntry `xml:"Contents"`
+	IsTruncated           bool        `xml:"IsTruncated"`
+	ContinuationToken     string      `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string      `xml:"NextContinuationToken,omitempty"`
+}
+
+// serveList はキー順に MaxKeys 件ずつ返す
+// continuation-token には前のページの最後のキーを入れて返し、その次から続ける
+func (s *Server) serveList(w http.ResponseWriter, bucket string, query url.Values) {
+	maxKeys := s.MaxKeys
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n >= 0 && n < maxKeys {
+		maxKeys = n
+	}
+	prefix := query.Get("prefix")
+	token := query.Get("continuation-token")
+	res := listResult{Name: bucket, Prefix: prefix, MaxKeys: maxKeys, ContinuationToken: token}
+	s.mu.Lock()
+	keys := []string{}
+	for k := range s.buckets[bucket] {
+		if strings.HasPrefix(k, prefix) && k > token {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	if len(keys) > maxKeys {
+		keys = keys[:maxKeys]
+		res.IsTruncated = true
+		if maxKeys > 0 {
+			res.NextContinuationToken = keys[maxKeys-1]
+		}
+	}
+	for _, k := range keys {
+		obj := s.buckets[bucket][k]
+		res.Contents = append(res.Contents, listEntry{
+			Key:          k,
+			Size:         len(obj.data),
+			LastModified: obj.modTime.UTC().Format("2006-01-02T15:04:05.000Z"),
+		})
+	}
+	s.mu.Unlock()
+	res.KeyCount = len(res.Contents)
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(http.StatusOK)
+	xml.NewEncoder(w).Encode(res)
+}
+
+// verify は Authorization ヘッダの Signature V4 を検証する
+func (s *Server) verify(r *http.Request, body []byte) bool {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 ") {
+		return false
+	}
+	fields := map[string]string{}
+	for _, f := range strings.Split(strings.TrimPrefix(auth, "AWS4-HMAC-SHA256 "), ",") {
+		kv := strings.SplitN(strings.TrimSpace(f), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	cred := strings.SplitN(fields["Credential"], "/", 2)
+	if len(cred) != 2 || cred[0] != s.AccessKey {
+		return false
+	}
+	scope := cred[1]
+	scopeParts := strings.Split(scope, "/")
+	if len(scopeParts) != 4 || scopeParts[2] != "s3" || scopeParts[3] != "aws4_request" {
+		return false
+	}
+
+	payloadHash := sha256Hex(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return false
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil || !strings.HasPrefix(amzDate, scopeParts[0]) {
+		return false
+	}
+	if d := s.Now().Sub(t); d > 15*time.Minute || d < -15*time.Minute {
+		return false
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	headers := []string{}
+	for _, h := range signed {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		headers = append(headers, h+":"+strings.TrimSpace(v))
+	}
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		uriEscape(r.URL.Path, false),
+		canonicalQuery(r.URL.Query()),
+		strings.Join(headers, "\n"),
+		"",
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), scopeParts[0])
+	key = hmacSHA256(key, scopeParts[1])
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	expected := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	return hmac.Equal([]byte(expected), []byte(fields["Signature"]))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func uriEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := []string{}
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEscape(k, true)+"="+uriEscape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
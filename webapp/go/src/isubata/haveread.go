@@ -1,8 +1,14 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
 )
 
 const (
@@ -66,3 +72,102 @@ func getHaveRead(uID, chID int64) (int64, error) {
 	json.Unmarshal(data, &mID)
 	return mID, nil
 }
+
+// 既読位置は進めるだけで戻さない
+var advanceHaveReadScript = redis.NewScript(1, `
+local cur = tonumber(redis.call('HGET', KEYS[1], ARGV[1]) or '0')
+if tonumber(ARGV[2]) > cur then
+  redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+  return 1
+end
+return 0
+`)
+
+// advanceHaveRead はチャンネルごとの既読位置(channel_id => message_id)をまとめて進める
+func advanceHaveRead(uID int64, reads map[int64]int64) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for chID, mID := range reads {
+		_, err := advanceHaveReadScript.Do(r.Conn, HAVE_READ_KEY, makeHaveReadField(uID, chID), mID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//request handlers
+
+// postChannelRead は message_id まで、省略されればチャンネルの最新まで既読にする
+func postChannelRead(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return ErrBadReqeust
+	}
+
+	var mID int64
+	if s := c.FormValue("message_id"); s != "" {
+		mID, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || mID <= 0 {
+			return ErrBadReqeust
+		}
+		err = db.Get(&mID, "SELECT id FROM message WHERE id = ? AND channel_id = ?", mID, chID)
+		if err == sql.ErrNoRows {
+			return ErrBadReqeust
+		}
+	} else {
+		var maxID sql.NullInt64
+		err = db.Get(&maxID, "SELECT MAX(id) FROM message WHERE channel_id = ?", chID)
+		mID = maxID.Int64
+	}
+	if err != nil {
+		return err
+	}
+
+	if mID > 0 {
+		if err := advanceHaveRead(userID, map[int64]int64{chID: mID}); err != nil {
+			return err
+		}
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postReadAll(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	rows, err := db.Query("SELECT m.channel_id, MAX(m.id) FROM message AS m" +
+		" INNER JOIN channel AS c ON c.id = m.channel_id WHERE c.archived_at IS NULL GROUP BY m.channel_id")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	reads := map[int64]int64{}
+	for rows.Next() {
+		var chID, mID int64
+		if err := rows.Scan(&chID, &mID); err != nil {
+			return err
+		}
+		reads[chID] = mID
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if err := advanceHaveRead(userID, reads); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
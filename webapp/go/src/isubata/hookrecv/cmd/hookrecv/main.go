@@ -0,0 +1,36 @@
+// 手元で送信 Webhook を試すための受信側
+//
+//	go run isubata/hookrecv/cmd/hookrecv -addr 127.0.0.1:5060 -secret <作成時に表示されたシークレット>
+//
+// チャンネルの編集画面で http://127.0.0.1:5060/ を送信 Webhook に登録する。
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"isubata/hookrecv"
+)
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:5060", "listen address")
+	secret := flag.String("secret", "", "signing secret of the outgoing webhook")
+	failFirst := flag.Int("fail-first", 0, "respond 500 to the first N requests")
+	flag.Parse()
+
+	rv := hookrecv.New(*secret)
+	rv.FailFirst = *failFirst
+
+	log.Printf("webhook receiver listening on http://%s/", *addr)
+	log.Fatal(http.ListenAndServe(*addr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := len(rv.Deliveries())
+		rv.ServeHTTP(w, r)
+		if ds := rv.Deliveries(); len(ds) > n {
+			d := ds[len(ds)-1]
+			log.Printf("delivery %s (attempt %d): %v", d.ID, d.Attempt, d.Payload)
+		} else {
+			log.Printf("rejected request %d", rv.Requests())
+		}
+	})))
+}
@@ -0,0 +1,114 @@
+// Package hookrecv はテストと手元での動作確認用の outgoing webhook の受信側
+//
+// 署名を検証して受け取った配信を記録する。FailFirst で最初の何回かを 500 にして再送を試せる。
+// httptest.NewServer(r) で起動し、そのURLを isubata の送信 Webhook に登録して使う。
+package hookrecv
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Delivery は受け取った1回分の配信
+type Delivery struct {
+	ID      string
+	Attempt int
+	Payload map[string]interface{}
+}
+
+type Receiver struct {
+	Secret string
+	// 署名の時刻がこれより古いものは拒否する。0 なら検査しない
+	Tolerance time.Duration
+	// 最初の FailFirst 回は 500 を返す
+	FailFirst int
+	// テストで時刻を固定できるようにする
+	Now func() time.Time
+
+	mu         sync.Mutex
+	requests   int
+	deliveries []Delivery
+}
+
+func New(secret string) *Receiver {
+	return &Receiver{
+		Secret:    secret,
+		Tolerance: 5 * time.Minute,
+		Now:       time.Now,
+	}
+}
+
+// Sign は isubata と同じく "<timestamp>.<body>" の HMAC-SHA256 を返す
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Deliveries は署名が正しく、成功を返した配信を受け取った順に返す
+func (rv *Receiver) Deliveries() []Delivery {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return append([]Delivery(nil), rv.deliveries...)
+}
+
+// Requests は失敗させたものも含めて受け取った回数を返す
+func (rv *Receiver) Requests() int {
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	return rv.requests
+}
+
+func (rv *Receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ts, err := strconv.ParseInt(r.Header.Get("X-Isubata-Timestamp"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid timestamp", http.StatusBadRequest)
+		return
+	}
+	if rv.Tolerance > 0 && rv.Now().Sub(time.Unix(ts, 0)) > rv.Tolerance {
+		http.Error(w, "timestamp too old", http.StatusUnauthorized)
+		return
+	}
+	if !hmac.Equal([]byte(r.Header.Get("X-Isubata-Signature")), []byte(Sign(rv.Secret, ts, body))) {
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	var payload map[string]interface{}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid payload", http.StatusBadRequest)
+		return
+	}
+	attempt, _ := strconv.Atoi(r.Header.Get("X-Isubata-Attempt"))
+
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	rv.requests++
+	if rv.requests <= rv.FailFirst {
+		http.Error(w, "failing on purpose", http.StatusInternalServerError)
+		return
+	}
+	rv.deliveries = append(rv.deliveries, Delivery{
+		ID:      r.Header.Get("X-Isubata-Delivery"),
+		Attempt: attempt,
+		Payload: payload,
+	})
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/sha1"
+	"image"
+	"image/color"
+	"image/draw"
+	"log"
+)
+
+const (
+	identiconCells  = 5
+	identiconCell   = 40
+	identiconMargin = 28
+	identiconSize   = identiconCells*identiconCell + identiconMargin*2
+)
+
+var identiconBackground = color.RGBA{0xf0, 0xf0, 0xf0, 0xff}
+
+// identicon はユーザ名から決まる 5x5 の左右対称な模様を描く
+// sha1 の先頭2バイトで色相、続く2バイトで彩度と明度、残りで塗るマスを決める
+func identicon(name string) *image.RGBA {
+	sum := sha1.Sum([]byte(name))
+	fg := hslToRGBA(
+		float64(int(sum[0])<<8|int(sum[1]))/65536,
+		0.45+float64(sum[2])/255*0.2,
+		0.45+float64(sum[3])/255*0.15,
+	)
+
+	img := image.NewRGBA(image.Rect(0, 0, identiconSize, identiconSize))
+	draw.Draw(img, img.Bounds(), &image.Uniform{identiconBackground}, image.ZP, draw.Src)
+	half := (identiconCells + 1) / 2
+	for y := 0; y < identiconCells; y++ {
+		for x := 0; x < half; x++ {
+			bit := y*half + x
+			if sum[4+bit/8]>>uint(bit%8)&1 == 0 {
+				continue
+			}
+			for _, cx := range []int{x, identiconCells - 1 - x} {
+				r := image.Rect(0, 0, identiconCell, identiconCell).
+					Add(image.Pt(identiconMargin+cx*identiconCell, identiconMargin+y*identiconCell))
+				draw.Draw(img, r, &image.Uniform{fg}, image.ZP, draw.Src)
+			}
+		}
+	}
+	return img
+}
+
+func hslToRGBA(h, s, l float64) color.RGBA {
+	var q float64
+	if l < 0.5 {
+		q = l * (1 + s)
+	} else {
+		q = l + s - l*s
+	}
+	p := 2*l - q
+	hue := func(t float64) uint8 {
+		if t < 0 {
+			t++
+		}
+		if t > 1 {
+			t--
+		}
+		var v float64
+		switch {
+		case t < 1.0/6:
+			v = p + (q-p)*6*t
+		case t < 1.0/2:
+			v = q
+		case t < 2.0/3:
+			v = p + (q-p)*(2.0/3-t)*6
+		default:
+			v = p
+		}
+		return uint8(v*255 + 0.5)
+	}
+	return color.RGBA{hue(h + 1.0/3), hue(h), hue(h - 1.0/3), 0xff}
+}
+
+// setIdenticonAvatar は登録したばかりのユーザに identicon をアイコンとして設定する
+// 置けなかったときは default.png のままにして登録は続ける
+func setIdenticonAvatar(userID int64, name string) {
+	avatar, err := buildAvatar(identicon(name), "png")
+	if err == nil {
+		err = saveAvatar(userID, avatar)
+	}
+	if err != nil {
+		log.Println(err, "IN setIdenticonAvatar")
+	}
+}
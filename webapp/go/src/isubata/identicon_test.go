@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestIdenticonIsDeterministic(t *testing.T) {
+	a1, err := buildAvatar(identicon("alice"), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := buildAvatar(identicon("alice"), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a1.Name != a2.Name || !bytes.Equal(a1.Data, a2.Data) {
+		t.Errorf("same name gave %s and %s", a1.Name, a2.Name)
+	}
+	if want := fmt.Sprintf("%x.png", sha1.Sum(a1.Data)); a1.Name != want {
+		t.Errorf("name = %s, want %s", a1.Name, want)
+	}
+	for _, size := range avatarThumbnailSizes {
+		if a1.Thumbnails[size].Name != a2.Thumbnails[size].Name {
+			t.Errorf("thumbnail %d differs", size)
+		}
+	}
+
+	b, err := buildAvatar(identicon("bob"), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Name == a1.Name || bytes.Equal(b.Data, a1.Data) {
+		t.Error("different names gave the same identicon")
+	}
+
+	img, err := png.Decode(bytes.NewReader(a1.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Bounds().Dx() != identiconSize || img.Bounds().Dy() != identiconSize {
+		t.Errorf("size = %v", img.Bounds())
+	}
+	// 左右対称
+	for y := 0; y < identiconSize; y += 7 {
+		for x := 0; x < identiconSize/2; x += 7 {
+			if img.At(x, y) != img.At(identiconSize-1-x, y) {
+				t.Fatalf("not symmetric at (%d, %d)", x, y)
+			}
+		}
+	}
+}
+
+func TestSetIdenticonAvatar(t *testing.T) {
+	requireDB(t)
+
+	dir, err := ioutil.TempDir("", "isubata-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s BlobStore) { iconStore = s }(iconStore)
+	iconStore = newLocalBlobStore(dir)
+
+	name := testName("identicon")
+	userID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	setIdenticonAvatar(userID, name)
+
+	want, err := buildAvatar(identicon(name), "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := getUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.AvatarIcon != want.Name {
+		t.Errorf("avatar_icon = %s, want %s", u.AvatarIcon, want.Name)
+	}
+	blob, err := iconStore.Get(want.Name)
+	if err != nil || !bytes.Equal(blob.Data, want.Data) {
+		t.Errorf("stored icon differs: err = %v", err)
+	}
+}
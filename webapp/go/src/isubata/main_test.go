@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// MySQL と Redis はアプリと同じ環境変数の接続先を使う。つながらなければそれを使うテストは飛ばす
+var (
+	testDBReady    bool
+	testRedisReady bool
+)
+
+func TestMain(m *testing.M) {
+	if conn, err := sqlx.Open("mysql", dbDSN()); err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		if conn.PingContext(ctx) == nil {
+			db = conn
+			testDBReady = true
+		}
+		cancel()
+	}
+	if r, err := NewRedisful(); err == nil {
+		r.Close()
+		testRedisReady = true
+	}
+	os.Exit(m.Run())
+}
+
+func requireDB(t *testing.T) {
+	t.Helper()
+	if !testDBReady {
+		t.Skip("MySQL is not available")
+	}
+}
+
+func requireRedis(t *testing.T) {
+	t.Helper()
+	if !testRedisReady {
+		t.Skip("Redis is not available")
+	}
+}
+
+func testName(prefix string) string {
+	return fmt.Sprintf("%s%d", prefix, time.Now().UnixNano()%1000000000)
+}
+
+// insertTestUser と insertTestChannel で作った行は呼んだ側で消す
+func insertTestUser(t *testing.T, name string, role Role) int64 {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, role, created_at)"+
+		" VALUES (?, '', '', ?, 'default.png', ?, NOW())", name, name, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+func insertTestChannel(t *testing.T, name string, createdBy int64) int64 {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO channel (name, description, created_by, updated_at, created_at) VALUES (?, '', ?, NOW(), NOW())",
+		name, createdBy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// newTestApp はセッションだけを持つ echo を起動する。ルートは呼んだ側で足す
+// GET /test/login/:user_id でそのユーザとしてログインできる
+func newTestApp(t *testing.T) (*echo.Echo, *httptest.Server) {
+	t.Helper()
+	cfg, err := loadSessionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Renderer = &Renderer{
+		templates: template.Must(template.New("").Funcs(template.FuncMap{
+			"add":    tAdd,
+			"xrange": tRange,
+		}).ParseGlob("views/*.html")),
+	}
+	e.Use(session.Middleware(newSessionStore(cfg)))
+	e.GET("/test/login/:user_id", func(c echo.Context) error {
+		id, _ := strconv.ParseInt(c.Param("user_id"), 10, 64)
+		sessSetUserID(c, id)
+		return c.NoContent(http.StatusNoContent)
+	})
+	return e, httptest.NewServer(e)
+}
+
+// newTestClient はリダイレクトをたどらない、クッキーを持つクライアント。userID が 0 でなければログインしておく
+func newTestClient(t *testing.T, app *httptest.Server, userID int64) *http.Client {
+	t.Helper()
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	if userID != 0 {
+		res, err := client.Get(fmt.Sprintf("%s/test/login/%d", app.URL, userID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+	}
+	return client
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"container/list"
+	"html"
+	"html/template"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// メッセージ用の Markdown のサブセット
+//   - ``` で囲んだコードブロック、`インラインコード`
+//   - **太字**、*斜体*、_斜体_
+//   - http(s) の URL の自動リンク
+//   - > で始まる引用
+//
+// 入力の HTML はすべてエスケープし、ここで組み立てたタグだけを出力する。
+// 改行はチャットらしく <br> にする。
+
+const markdownCacheSize = 10000
+
+var codeLanguagePattern = regexp.MustCompile(`^[A-Za-z0-9_+-]{1,32}$`)
+
+// renderMarkdown は content を安全な HTML にする
+func renderMarkdown(content string) template.HTML {
+	lines := strings.Split(strings.Replace(content, "\r\n", "\n", -1), "\n")
+	var b strings.Builder
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			lang := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(line), "```"))
+			i++
+			start := i
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "```" {
+				i++
+			}
+			code := strings.Join(lines[start:i], "\n")
+			// 閉じていなければ最後までをコードにする
+			if i < len(lines) {
+				i++
+			}
+			b.WriteString("<pre><code")
+			if codeLanguagePattern.MatchString(lang) {
+				b.WriteString(` class="language-` + lang + `"`)
+			}
+			b.WriteString(">" + html.EscapeString(code) + "</code></pre>")
+		case strings.HasPrefix(line, ">"):
+			quoted := []string{}
+			for i < len(lines) && strings.HasPrefix(lines[i], ">") {
+				quoted = append(quoted, renderInline(strings.TrimPrefix(lines[i][1:], " ")))
+				i++
+			}
+			b.WriteString("<blockquote>" + strings.Join(quoted, "<br>") + "</blockquote>")
+		case strings.TrimSpace(line) == "":
+			i++
+		default:
+			para := []string{}
+			for i < len(lines) && strings.TrimSpace(lines[i]) != "" &&
+				!strings.HasPrefix(lines[i], ">") && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```") {
+				para = append(para, renderInline(lines[i]))
+				i++
+			}
+			b.WriteString("<p>" + strings.Join(para, "<br>") + "</p>")
+		}
+	}
+	return template.HTML(b.String())
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+// renderInline は1行分を変換する。強調は行をまたがない
+func renderInline(s string) string {
+	var b strings.Builder
+	plain := 0
+	flush := func(i int) {
+		b.WriteString(html.EscapeString(s[plain:i]))
+	}
+	for i := 0; i < len(s); {
+		switch {
+		case s[i] == '`':
+			if j := strings.IndexByte(s[i+1:], '`'); j > 0 {
+				flush(i)
+				b.WriteString("<code>" + html.EscapeString(s[i+1:i+1+j]) + "</code>")
+				i += j + 2
+				plain = i
+				continue
+			}
+		case strings.HasPrefix(s[i:], "http://") || strings.HasPrefix(s[i:], "https://"):
+			if i == 0 || !isWordByte(s[i-1]) {
+				if n := autolinkLength(s[i:]); n > 0 {
+					flush(i)
+					u := html.EscapeString(s[i : i+n])
+					b.WriteString(`<a href="` + u + `" target="_blank" rel="nofollow noopener noreferrer">` + u + `</a>`)
+					i += n
+					plain = i
+					continue
+				}
+			}
+		case strings.HasPrefix(s[i:], "**"):
+			if j := strings.Index(s[i+2:], "**"); j > 0 && s[i+2] != ' ' && s[i+1+j] != ' ' {
+				flush(i)
+				b.WriteString("<strong>" + renderInline(s[i+2:i+2+j]) + "</strong>")
+				i += j + 4
+				plain = i
+				continue
+			}
+		case s[i] == '*' || s[i] == '_':
+			// snake_case の _ を拾わないよう、_ は単語の境目だけで扱う
+			d := s[i]
+			if d == '_' && i > 0 && isWordByte(s[i-1]) {
+				break
+			}
+			if j := strings.IndexByte(s[i+1:], d); j > 0 && s[i+1] != ' ' && s[i+j] != ' ' {
+				end := i + 1 + j
+				if d == '_' && end+1 < len(s) && isWordByte(s[end+1]) {
+					break
+				}
+				flush(i)
+				b.WriteString("<em>" + renderInline(s[i+1:end]) + "</em>")
+				i = end + 1
+				plain = i
+				continue
+			}
+		}
+		i++
+	}
+	flush(len(s))
+	return b.String()
+}
+
+// autolinkLength は s の先頭の URL の長さを返す。文末の句読点と閉じていない括弧は含めない
+func autolinkLength(s string) int {
+	n := strings.IndexAny(s, " \t<>\"'`")
+	if n < 0 {
+		n = len(s)
+	}
+	for n > 0 {
+		c := s[n-1]
+		if strings.IndexByte(".,:;!?", c) >= 0 {
+			n--
+			continue
+		}
+		if c == ')' && strings.Count(s[:n], "(") < strings.Count(s[:n], ")") {
+			n--
+			continue
+		}
+		break
+	}
+	if n <= len("https://") || strings.HasSuffix(s[:n], "://") {
+		return 0
+	}
+	return n
+}
+
+// messageHTMLCache は変換結果をメッセージごとに持つ LRU
+// /initialize の後は id が使い回されうるので、本文が同じときだけ使う
+type messageHTMLCache struct {
+	mu      sync.Mutex
+	entries map[int64]*list.Element
+	order   *list.List
+}
+
+type messageHTMLEntry struct {
+	id      int64
+	content string
+	html    template.HTML
+}
+
+var markdownCache = &messageHTMLCache{
+	entries: map[int64]*list.Element{},
+	order:   list.New(),
+}
+
+func (c *messageHTMLCache) get(m Message) (template.HTML, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[m.ID]
+	if !ok || e.Value.(*messageHTMLEntry).content != m.Content {
+		return "", false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*messageHTMLEntry).html, true
+}
+
+func (c *messageHTMLCache) put(m Message, h template.HTML) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[m.ID]; ok {
+		e.Value = &messageHTMLEntry{id: m.ID, content: m.Content, html: h}
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[m.ID] = c.order.PushFront(&messageHTMLEntry{id: m.ID, content: m.Content, html: h})
+	if c.order.Len() > markdownCacheSize {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*messageHTMLEntry).id)
+	}
+}
+
+// messageContentHTML はキャッシュを通して content を HTML にする
+func messageContentHTML(m Message) template.HTML {
+	if h, ok := markdownCache.get(m); ok {
+		return h
+	}
+	h := renderMarkdown(m.Content)
+	markdownCache.put(m, h)
+	return h
+}
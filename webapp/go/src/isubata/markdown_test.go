@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"testing"
+)
+
+const testLinkAttrs = `" target="_blank" rel="nofollow noopener noreferrer">`
+
+func testLink(u string) string {
+	return `<a href="` + u + testLinkAttrs + u + `</a>`
+}
+
+func TestRenderMarkdown(t *testing.T) {
+	cases := []struct {
+		name, in, want string
+	}{
+		{"script in text", "<script>alert(1)</script>",
+			"<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"script in code span", "`<script>alert(1)</script>`",
+			"<p><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></p>"},
+		{"script in fence", "```\n<script>alert(1)</script>\n```",
+			"<pre><code>&lt;script&gt;alert(1)&lt;/script&gt;</code></pre>"},
+		{"closing tags in fence", "```js\n</code></pre><script>x</script>\n```",
+			`<pre><code class="language-js">&lt;/code&gt;&lt;/pre&gt;&lt;script&gt;x&lt;/script&gt;</code></pre>`},
+		{"fence language injection", "```x\" onmouseover=\"alert(1)\ncode\n```",
+			"<pre><code>code</code></pre>"},
+		{"unclosed fence", "```\nunclosed <b>",
+			"<pre><code>unclosed &lt;b&gt;</code></pre>"},
+		{"script in quote", "> <script>quote</script>\n> **b**",
+			"<blockquote>&lt;script&gt;quote&lt;/script&gt;<br><strong>b</strong></blockquote>"},
+		{"double quote ends url", `see http://example.com/?q="><script>alert(1)</script>`,
+			"<p>see " + testLink("http://example.com/?q=") + "&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;</p>"},
+		{"single quote ends url", "see https://example.com/a'onmouseover='alert(1)",
+			"<p>see " + testLink("https://example.com/a") + "&#39;onmouseover=&#39;alert(1)</p>"},
+		{"angle bracket ends url", "see https://example.com/a<b>c",
+			"<p>see " + testLink("https://example.com/a") + "&lt;b&gt;c</p>"},
+		{"ampersand in url", "https://example.com/?a=1&b=2",
+			"<p>" + testLink("https://example.com/?a=1&amp;b=2") + "</p>"},
+		{"javascript url", "javascript:alert(1)",
+			"<p>javascript:alert(1)</p>"},
+		{"javascript markdown link", "[x](javascript:alert(1))",
+			"<p>[x](javascript:alert(1))</p>"},
+		{"url inside a word", "xhttps://example.com",
+			"<p>xhttps://example.com</p>"},
+		{"scheme only", "https://",
+			"<p>https://</p>"},
+		{"nested emphasis", "**bold *and em* inside**",
+			"<p><strong>bold <em>and em</em> inside</strong></p>"},
+		{"tag in emphasis", "*<img src=x onerror=alert(1)>*",
+			"<p><em>&lt;img src=x onerror=alert(1)&gt;</em></p>"},
+		{"unclosed strong", "**unclosed bold",
+			"<p>**unclosed bold</p>"},
+		{"unclosed star", "*unclosed em",
+			"<p>*unclosed em</p>"},
+		{"unclosed underscore", "_unclosed",
+			"<p>_unclosed</p>"},
+		{"spaced strong", "** not bold **",
+			"<p>** not bold **</p>"},
+		{"stars only", "***",
+			"<p>***</p>"},
+		{"snake_case", "__init__ and snake_case_name",
+			"<p>__init__ and snake_case_name</p>"},
+		{"underscore and star", "_em_ and *em*",
+			"<p><em>em</em> and <em>em</em></p>"},
+		{"trailing period", "Visit https://example.com.",
+			"<p>Visit " + testLink("https://example.com") + ".</p>"},
+		{"trailing comma", "Visit https://example.com/path, then",
+			"<p>Visit " + testLink("https://example.com/path") + ", then</p>"},
+		{"balanced paren", "(see https://en.wikipedia.org/wiki/Go_(language))",
+			"<p>(see " + testLink("https://en.wikipedia.org/wiki/Go_(language)") + ")</p>"},
+		{"unbalanced paren", "(see https://example.com/a)",
+			"<p>(see " + testLink("https://example.com/a") + ")</p>"},
+		{"lines", "a\nb\n\nc",
+			"<p>a<br>b</p><p>c</p>"},
+	}
+	for _, c := range cases {
+		if got := string(renderMarkdown(c.in)); got != c.want {
+			t.Errorf("%s: renderMarkdown(%q)\n got %q\nwant %q", c.name, c.in, got, c.want)
+		}
+	}
+}
+
+func TestAutolinkLength(t *testing.T) {
+	cases := map[string]int{
+		"https://example.com":         19,
+		"https://example.com.":        19,
+		"https://example.com/a?!":     21,
+		"https://example.com/a).":     21,
+		"https://example.com/(a)":     23,
+		"https://example.com/(a))":    23,
+		"https://example.com/a b":     21,
+		"https://example.com/a\"b":    21,
+		"https://example.com/a`b`":    21,
+		"https://":                    0,
+		"https://...":                 0,
+		"https://x.com/(((":           17,
+		"https://example.com/a>&lt;b": 21,
+	}
+	for s, want := range cases {
+		if got := autolinkLength(s); got != want {
+			t.Errorf("autolinkLength(%q) = %d, want %d", s, got, want)
+		}
+	}
+}
+
+// /initialize の後に同じ id で別の本文が来たら、前の結果を返さない
+func TestMessageHTMLCache(t *testing.T) {
+	defer func(c *messageHTMLCache) { markdownCache = c }(markdownCache)
+	markdownCache = &messageHTMLCache{entries: map[int64]*list.Element{}, order: list.New()}
+
+	m := Message{ID: 1, Content: "**old**"}
+	if got := messageContentHTML(m); got != "<p><strong>old</strong></p>" {
+		t.Fatalf("got %q", got)
+	}
+	if _, ok := markdownCache.get(m); !ok {
+		t.Error("not cached")
+	}
+
+	m.Content = "<script>new</script>"
+	if _, ok := markdownCache.get(m); ok {
+		t.Error("served a stale entry for a different body")
+	}
+	if got := messageContentHTML(m); got != "<p>&lt;script&gt;new&lt;/script&gt;</p>" {
+		t.Errorf("got %q", got)
+	}
+	if markdownCache.order.Len() != 1 {
+		t.Errorf("entries = %d", markdownCache.order.Len())
+	}
+}
@@ -1,8 +1,9 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
-
+	"log"
 	"net/http"
 	"strconv"
 	"time"
@@ -13,6 +14,15 @@ import (
 
 const (
 	messageCountPrefix = "MESSAGE-NUM-CHANNEL-"
+
+	MessageKindText = "text"
+	// /me の発言
+	MessageKindMe = "me"
+	// /topic や /invite の結果
+	MessageKindSystem = "system"
+	MessageKindBot    = "bot"
+	// incoming webhook からの投稿
+	MessageKindWebhook = "webhook"
 )
 
 func makeMessageCountKey(chID int64) string {
@@ -88,61 +98,102 @@ func incrementMessageCount(chID int64) error {
 }
 
 func addMessage(channelID, userID int64, content string) (int64, error) {
-	res, err := db.Exec(
-		"INSERT INTO message (channel_id, user_id, content, created_at) VALUES (?, ?, ?, NOW())",
-		channelID, userID, content)
+	return addMessageWithKind(channelID, userID, MessageKindText, content)
+}
+
+func addMessageWithKind(channelID, userID int64, kind, content string) (int64, error) {
+	return insertMessage(Message{ChannelID: channelID, UserID: userID, Kind: kind, Content: content})
+}
+
+// insertMessage は投稿の共通の入口。件数のキャッシュとチャンネルの更新日時も更新する
+func insertMessage(m Message) (int64, error) {
+	return insertMessageWithAttachments(m, nil)
+}
+
+// insertMessageWithAttachments は添付を BlobStore に置いてから、メッセージと添付を1つのトランザクションで書く
+// 途中で失敗してもメッセージは残らないので、クライアントが送り直しても重複しない
+func insertMessageWithAttachments(m Message, uploads []attachmentUpload) (int64, error) {
+	if err := putAttachmentBlobs(uploads); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Beginx()
 	if err != nil {
 		return 0, err
 	}
-	if err = incrementMessageCount(channelID); err != nil {
+	defer tx.Rollback()
+	res, err := tx.Exec(
+		"INSERT INTO message (channel_id, user_id, content, kind, sender_name, sender_icon, created_at)"+
+			" VALUES (?, ?, ?, ?, ?, ?, NOW())",
+		m.ChannelID, m.UserID, m.Content, m.Kind, m.SenderName, m.SenderIcon)
+	if err != nil {
+		return 0, err
+	}
+	m.ID, err = res.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := insertAttachmentRows(tx, m.ID, uploads); err != nil {
+		return 0, err
+	}
+	// サイドバーの並び順に使う。キャッシュは期限切れを待つ
+	if _, err = tx.Exec("UPDATE channel SET updated_at = NOW() WHERE id = ?", m.ChannelID); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
 		return 0, err
 	}
 
-	return res.LastInsertId()
+	// 書き込んだ後なので、失敗してもエラーにはしない(送り直されると重複する)
+	if err := incrementMessageCount(m.ChannelID); err != nil {
+		log.Println(err, "IN insertMessage")
+	}
+	m.CreatedAt = time.Now()
+	onMessageAdded(m)
+	return m.ID, nil
+}
+
+// m.* だと列を足すたびに Scan がずれるので列を並べる
+const messageWithUserColumns = "m.id, m.channel_id, m.user_id, m.content, m.kind, m.sender_name, m.sender_icon," +
+	" m.created_at, u.id, u.name, u.display_name, u.avatar_icon, u.avatar_icon_128"
+
+// scanMessageWithUser は messageWithUserColumns の後に続く列を extra に読む
+func scanMessageWithUser(rows *sql.Rows, extra ...interface{}) (Message, error) {
+	var m Message
+	dest := []interface{}{&m.ID, &m.ChannelID, &m.UserID, &m.Content, &m.Kind, &m.SenderName, &m.SenderIcon,
+		&m.CreatedAt, &m.User.ID, &m.User.Name, &m.User.DisplayName, &m.User.AvatarIcon,
+		&m.User.AvatarIcon128}
+	err := rows.Scan(append(dest, extra...)...)
+	return m, err
 }
 
 func queryMessagesWithUser(chID, lastID int64, paginate bool, limit, offset int64) ([]Message, error) {
-	msgs := []Message{}
+	var rows *sql.Rows
+	var err error
 	if paginate {
-		rows, err := db.Query("SELECT m.*, u.* FROM message AS m "+
+		rows, err = db.Query("SELECT "+messageWithUserColumns+" FROM message AS m "+
 			"INNER JOIN user AS u ON m.user_id = u.id "+
 			"WHERE m.channel_id = ? ORDER BY m.id DESC LIMIT ? OFFSET ?",
 			chID, limit, offset)
-
-		if err != nil {
-			return nil, err
-		}
-
-		for rows.Next() {
-			var m Message
-			var u User
-			err := rows.Scan(&m.ID, &m.ChannelID, &m.UserID, &m.Content, &m.CreatedAt, &u.ID, &u.Name, &u.Salt, &u.Password, &u.DisplayName, &u.AvatarIcon, &u.CreatedAt)
-			if err != nil {
-				return nil, err
-			}
-			m.User = u
-			msgs = append(msgs, m)
-		}
 	} else {
-		rows, err := db.Query("SELECT m.*, u.* FROM message AS m "+
+		rows, err = db.Query("SELECT "+messageWithUserColumns+" FROM message AS m "+
 			"INNER JOIN user AS u ON m.user_id = u.id "+
 			"WHERE m.id > ? AND m.channel_id = ? ORDER BY m.id DESC LIMIT 100",
 			lastID,
 			chID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []Message{}
+	for rows.Next() {
+		m, err := scanMessageWithUser(rows)
 		if err != nil {
 			return nil, err
 		}
-
-		for rows.Next() {
-			var m Message
-			var u User
-			err := rows.Scan(&m.ID, &m.ChannelID, &m.UserID, &m.Content, &m.CreatedAt, &u.ID, &u.Name, &u.Salt, &u.Password, &u.DisplayName, &u.AvatarIcon, &u.CreatedAt)
-			if err != nil {
-				return nil, err
-			}
-			m.User = u
-			msgs = append(msgs, m)
-		}
+		msgs = append(msgs, m)
 	}
 	return msgs, nil
 }
@@ -153,6 +204,22 @@ func jsonifyMessageWithUser(message Message) map[string]interface{} {
 	r["user"] = message.User
 	r["date"] = message.CreatedAt.Format("2006/01/02 15:04:05")
 	r["content"] = message.Content
+	// Markdown を変換してサニタイズした HTML。/me とシステムメッセージは content をそのまま表示する
+	r["content_html"] = messageContentHTML(message)
+	r["kind"] = message.Kind
+	if len(message.Attachments) > 0 {
+		attachments := make([]map[string]interface{}, 0, len(message.Attachments))
+		for _, a := range message.Attachments {
+			attachments = append(attachments, jsonifyAttachment(a))
+		}
+		r["attachments"] = attachments
+	}
+	if message.SenderName != "" || message.SenderIcon != "" {
+		r["sender"] = map[string]string{
+			"display_name": message.SenderName,
+			"icon_url":     senderIconURL(message.SenderIcon),
+		}
+	}
 
 	return r
 }
@@ -171,11 +238,6 @@ func postMessage(c echo.Context) error {
 		return err
 	}
 
-	message := c.FormValue("message")
-	if message == "" {
-		return echo.ErrForbidden
-	}
-
 	var chanID int64
 	if x, err := strconv.Atoi(c.FormValue("channel_id")); err != nil {
 		return echo.ErrForbidden
@@ -183,9 +245,47 @@ func postMessage(c echo.Context) error {
 		chanID = int64(x)
 	}
 
-	if _, err := addMessage(chanID, user.ID, message); err != nil {
+	ch, err := getChannelInfo(chanID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return echo.ErrForbidden
+	}
+	if err := requireChannelPermission(user, ch, PermPostMessage); err != nil {
+		return err
+	}
+
+	// 添付は投稿できると分かってから読む
+	uploads, err := readAttachments(c)
+	if err != nil {
+		return err
+	}
+	message := c.FormValue("message")
+	// 添付があれば本文は空でもよい
+	if message == "" && len(uploads) == 0 {
+		return echo.ErrForbidden
+	}
+
+	if isSlashCommand(message) {
+		if len(uploads) > 0 {
+			return commandError("コマンドにはファイルを添付できません")
+		}
+		if err := runSlashCommand(user, ch, message); err != nil {
+			return err
+		}
+		return c.NoContent(204)
+	}
+	_, err = insertMessageWithAttachments(Message{
+		ChannelID: chanID,
+		UserID:    user.ID,
+		Kind:      MessageKindText,
+		Content:   unescapeSlash(message),
+	}, uploads)
+	if err != nil {
 		return err
 	}
+	clearTyping(chanID, user.ID)
 
 	return c.NoContent(204)
 }
@@ -209,6 +309,9 @@ func getMessage(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := loadAttachments(messages); err != nil {
+		return err
+	}
 
 	response := make([]map[string]interface{}, 0)
 	for i := len(messages) - 1; i >= 0; i-- {
@@ -250,6 +353,24 @@ func fetchUnread(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	prefs, err := queryChannelPreferences(userID)
+	if err != nil {
+		return err
+	}
+	// メンションだけ通知するチャンネルがあるときだけ名前が要る
+	var name string
+	for _, p := range prefs {
+		if p.Notify == NotifyMentions && !p.Muted {
+			user, err := getUser(userID)
+			if err != nil {
+				return err
+			}
+			if user != nil {
+				name = user.Name
+			}
+			break
+		}
+	}
 
 	resp := []map[string]interface{}{}
 
@@ -273,9 +394,14 @@ func fetchUnread(c echo.Context) error {
 				}
 			}
 		}
+		unread, mutedUnread, err := splitUnread(prefs[chID], chID, lastID, cnt, name)
+		if err != nil {
+			return err
+		}
 		r := map[string]interface{}{
-			"channel_id": chID,
-			"unread":     cnt}
+			"channel_id":   chID,
+			"unread":       unread,
+			"muted_unread": mutedUnread}
 		resp = append(resp, r)
 	}
 
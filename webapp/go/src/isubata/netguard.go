@@ -0,0 +1,79 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+// 利用者が指定した URL にサーバから接続するとき(Webhook のアイコン、outgoing webhook)は、
+// 名前解決した後の接続先を見て、ループバックや社内のアドレスには繋がない
+
+var errNonPublicAddress = errors.New("connecting to a non-public address is not allowed")
+
+// IsPrivate などで判定できない、外から届くはずのないアドレス
+var nonPublicNets = func() []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, s := range []string{
+		"0.0.0.0/8",
+		"100.64.0.0/10", // CGNAT
+		"192.0.0.0/24",
+		"198.18.0.0/15",
+		"240.0.0.0/4",
+		"64:ff9b::/96", // NAT64 で内側の IPv4 に届く
+	} {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range nonPublicNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// publicDialControl は名前解決の後、接続する直前に呼ばれる。DNS の応答を差し替えられても効く
+func publicDialControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errNonPublicAddress
+	}
+	return nil
+}
+
+// newPublicHTTPClient は公開アドレスにだけ接続する http.Client を作る
+// 環境変数のプロキシを通すと接続先を確かめられないので使わない
+func newPublicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+		Control:   publicDialControl,
+	}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: timeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsPublicIP(t *testing.T) {
+	cases := map[string]bool{
+		"8.8.8.8":          true,
+		"2001:4860::8888":  true,
+		"127.0.0.1":        false,
+		"::1":              false,
+		"10.1.2.3":         false,
+		"172.16.0.1":       false,
+		"192.168.1.1":      false,
+		"169.254.169.254":  false,
+		"fe80::1":          false,
+		"fd00::1":          false,
+		"0.0.0.0":          false,
+		"::":               false,
+		"100.64.0.1":       false,
+		"::ffff:127.0.0.1": false,
+		"64:ff9b::a00:1":   false,
+	}
+	for s, want := range cases {
+		if got := isPublicIP(net.ParseIP(s)); got != want {
+			t.Errorf("isPublicIP(%s) = %v, want %v", s, got, want)
+		}
+	}
+}
+
+// 名前で指定しても、接続する時点のアドレスで断る
+func TestPublicHTTPClientRefusesLoopback(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("reached the loopback server")
+	}))
+	defer srv.Close()
+
+	client := newPublicHTTPClient(time.Second)
+	for _, u := range []string{srv.URL, strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)} {
+		res, err := client.Get(u)
+		if err == nil {
+			res.Body.Close()
+			t.Errorf("GET %s succeeded", u)
+			continue
+		}
+		if !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+			t.Errorf("GET %s: %v", u, err)
+		}
+	}
+}
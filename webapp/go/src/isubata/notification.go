@@ -0,0 +1,102 @@
+package main
+
+import "strings"
+
+// NotifyLevel はチャンネルごとにどのメッセージを未読として数えるか
+type NotifyLevel string
+
+const (
+	NotifyAll      NotifyLevel = "all"
+	NotifyMentions NotifyLevel = "mentions"
+	NotifyNothing  NotifyLevel = "nothing"
+)
+
+func validNotifyLevel(l NotifyLevel) bool {
+	switch l {
+	case NotifyAll, NotifyMentions, NotifyNothing:
+		return true
+	}
+	return false
+}
+
+type ChannelPreference struct {
+	ChannelID int64       `db:"channel_id"`
+	Muted     bool        `db:"muted"`
+	Notify    NotifyLevel `db:"notify"`
+}
+
+// queryChannelPreferences は設定を変えたチャンネルの分だけ返す
+func queryChannelPreferences(userID int64) (map[int64]ChannelPreference, error) {
+	prefs := []ChannelPreference{}
+	err := db.Select(&prefs, "SELECT channel_id, muted, notify FROM user_channel WHERE user_id = ?", userID)
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[int64]ChannelPreference, len(prefs))
+	for _, p := range prefs {
+		res[p.ChannelID] = p
+	}
+	return res, nil
+}
+
+// countUnreadMentions は lastID より後の @name を含むメッセージを数える
+// LIKE で候補を絞り、@name2 や foo@name.com を除くため境目は Go で確かめる
+func countUnreadMentions(chID, lastID int64, name string) (int64, error) {
+	contents := []string{}
+	err := db.Select(&contents,
+		"SELECT content FROM message WHERE channel_id = ? AND ? < id AND content LIKE ?",
+		chID, lastID, "%@"+escapeLike(name)+"%")
+	if err != nil {
+		return 0, err
+	}
+	var cnt int64
+	for _, content := range contents {
+		if mentions(content, name) {
+			cnt++
+		}
+	}
+	return cnt, nil
+}
+
+func isMentionBoundary(c byte) bool {
+	return !(c == '_' || '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z')
+}
+
+// mentions は content に @name が単語として含まれていれば true
+// 前後が英数字と _ でなければよいので、「@aliceさん」もメンションになる
+func mentions(content, name string) bool {
+	mention := "@" + name
+	for i := 0; ; {
+		j := strings.Index(content[i:], mention)
+		if j < 0 {
+			return false
+		}
+		start, end := i+j, i+j+len(mention)
+		if (start == 0 || isMentionBoundary(content[start-1])) && (end == len(content) || isMentionBoundary(content[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// splitUnread は未読を通知するもの(unread)としないもの(muted_unread)に分ける
+// 2つの合計は常にチャンネルの未読数になる
+func splitUnread(pref ChannelPreference, chID, lastID, cnt int64, name string) (unread, mutedUnread int64, err error) {
+	if cnt == 0 {
+		return 0, 0, nil
+	}
+	if pref.Muted {
+		return 0, cnt, nil
+	}
+	switch pref.Notify {
+	case NotifyNothing:
+		return 0, cnt, nil
+	case NotifyMentions:
+		mentions, err := countUnreadMentions(chID, lastID, name)
+		if err != nil {
+			return 0, 0, err
+		}
+		return mentions, cnt - mentions, nil
+	}
+	return cnt, 0, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import "testing"
+
+func TestMentions(t *testing.T) {
+	cases := map[string]bool{
+		"@alice":               true,
+		"hi @alice":            true,
+		"@alice, look":         true,
+		"(@alice)":             true,
+		"@aliceさん":             true,
+		"こんにちは @alice":         true,
+		"@alice2":              false,
+		"@alice_b":             false,
+		"mail alice@alice.com": false,
+		"foo@alice":            false,
+		"@alic":                false,
+		"@alice2 and @alice":   true,
+		"":                     false,
+	}
+	for content, want := range cases {
+		if got := mentions(content, "alice"); got != want {
+			t.Errorf("mentions(%q) = %v, want %v", content, got, want)
+		}
+	}
+}
+
+func TestCountUnreadMentions(t *testing.T) {
+	requireDB(t)
+
+	name := testName("mention")
+	chID := insertTestChannel(t, name, 0)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+
+	var first int64
+	for i, content := range []string{
+		"@" + name + " 読んでおいて",
+		"@" + name + "2 こっちは別の人",
+		"mail to x@" + name + ".example",
+		"@" + name + "さん、確認お願いします",
+		"メンションなし",
+	} {
+		id, err := addMessage(chID, 1, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			first = id
+		}
+	}
+
+	cnt, err := countUnreadMentions(chID, 0, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cnt != 2 {
+		t.Errorf("mentions = %d, want 2", cnt)
+	}
+	if cnt, _ := countUnreadMentions(chID, first, name); cnt != 1 {
+		t.Errorf("mentions after the first = %d, want 1", cnt)
+	}
+	unread, muted, err := splitUnread(ChannelPreference{Notify: NotifyMentions}, chID, 0, 5, name)
+	if err != nil || unread != 2 || muted != 3 {
+		t.Errorf("splitUnread = %d, %d, %v", unread, muted, err)
+	}
+}
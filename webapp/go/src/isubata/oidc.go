@@ -0,0 +1,478 @@
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	// 認可リクエストからコールバックまでの猶予(秒)
+	oidcPendingTTL = 600
+	// ID トークンの exp, iat の許容誤差(秒)
+	oidcClockSkew = 60
+	// IdP で認証してから、パスワードを持たないユーザの本人確認として認める時間(秒)
+	oidcReauthTTL = 600
+)
+
+var (
+	ErrInvalidIDToken = errors.New("invalid id token")
+
+	// テストで時刻を固定できるようにする
+	oidcNow = time.Now
+
+	oidcHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+	oidcOnce     sync.Once
+	oidcInstance *OIDCProvider
+
+	oidcUsernameRe = regexp.MustCompile(`[^a-zA-Z0-9_\-.]`)
+)
+
+type OIDCConfig struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// OIDCProvider は discovery と JWKS をキャッシュする
+// 知らない kid の ID トークンが来たら JWKS を取り直す
+type OIDCProvider struct {
+	Config OIDCConfig
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]*rsa.PublicKey
+}
+
+// ISUBATA_OIDC_ISSUER が空なら OIDC ログインは無効
+func loadOIDCConfig() *OIDCConfig {
+	issuer := os.Getenv("ISUBATA_OIDC_ISSUER")
+	if issuer == "" {
+		return nil
+	}
+	return &OIDCConfig{
+		Issuer:       strings.TrimRight(issuer, "/"),
+		ClientID:     os.Getenv("ISUBATA_OIDC_CLIENT_ID"),
+		ClientSecret: os.Getenv("ISUBATA_OIDC_CLIENT_SECRET"),
+		RedirectURL:  os.Getenv("ISUBATA_OIDC_REDIRECT_URL"),
+	}
+}
+
+func getOIDCProvider() *OIDCProvider {
+	oidcOnce.Do(func() {
+		if cfg := loadOIDCConfig(); cfg != nil {
+			oidcInstance = NewOIDCProvider(*cfg)
+		}
+	})
+	return oidcInstance
+}
+
+func NewOIDCProvider(cfg OIDCConfig) *OIDCProvider {
+	return &OIDCProvider{Config: cfg}
+}
+
+func oidcGetJSON(u string, v interface{}) error {
+	res, err := oidcHTTPClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (p *OIDCProvider) getDiscovery() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	if err := oidcGetJSON(p.Config.Issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if strings.TrimRight(d.Issuer, "/") != p.Config.Issuer {
+		return nil, fmt.Errorf("issuer mismatch in discovery: %q", d.Issuer)
+	}
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+func (p *OIDCProvider) getKey(kid string) (*rsa.PublicKey, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := oidcGetJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+		key, err := k.rsaPublicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[k.Kid] = key
+	}
+	p.keys = keys
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	return key, nil
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// PKCE (S256)
+func pkceChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *OIDCProvider) AuthCodeURL(state, nonce, verifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Config.ClientID)
+	v.Set("redirect_uri", p.Config.RedirectURL)
+	v.Set("scope", "openid profile email")
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", pkceChallenge(verifier))
+	v.Set("code_challenge_method", "S256")
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + v.Encode(), nil
+}
+
+// Exchange は認可コードを ID トークンに交換する
+func (p *OIDCProvider) Exchange(code, verifier string) (string, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", p.Config.RedirectURL)
+	v.Set("code_verifier", verifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+	req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+
+	res, err := oidcHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	var body struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", res.Status, body.Error)
+	}
+	return body.IDToken, nil
+}
+
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(b, &ss); err != nil {
+		return err
+	}
+	*a = ss
+	return nil
+}
+
+type IDTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	ExpiresAt         int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	Email             string       `json:"email"`
+	Name              string       `json:"name"`
+	PreferredUsername string       `json:"preferred_username"`
+}
+
+// 署名以外の検証は VerifyIDToken で行う
+func (c *IDTokenClaims) Valid() error {
+	return nil
+}
+
+func (p *OIDCProvider) VerifyIDToken(raw, nonce string) (*IDTokenClaims, error) {
+	claims := &IDTokenClaims{}
+	parser := &jwt.Parser{ValidMethods: []string{"RS256"}}
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.getKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := oidcNow().Unix()
+	switch {
+	case strings.TrimRight(claims.Issuer, "/") != p.Config.Issuer:
+		return nil, ErrInvalidIDToken
+	case claims.Subject == "":
+		return nil, ErrInvalidIDToken
+	case !claims.hasAudience(p.Config.ClientID):
+		return nil, ErrInvalidIDToken
+	case len(claims.Audience) > 1 && claims.AuthorizedParty != p.Config.ClientID:
+		return nil, ErrInvalidIDToken
+	case claims.ExpiresAt+oidcClockSkew < now:
+		return nil, ErrInvalidIDToken
+	case claims.IssuedAt-oidcClockSkew > now:
+		return nil, ErrInvalidIDToken
+	case nonce == "" || claims.Nonce != nonce:
+		return nil, ErrInvalidIDToken
+	}
+	return claims, nil
+}
+
+func (c *IDTokenClaims) hasAudience(clientID string) bool {
+	for _, aud := range c.Audience {
+		if aud == clientID {
+			return true
+		}
+	}
+	return false
+}
+
+// findOrProvisionOIDCUser は IdP の subject に紐付くユーザを返す
+// 未連携の場合、ログイン中ならそのユーザに紐付け、そうでなければユーザを作る
+func findOrProvisionOIDCUser(issuer string, claims *IDTokenClaims, currentUserID int64) (int64, error) {
+	var userID int64
+	err := db.Get(&userID,
+		"SELECT i.user_id FROM user_identity AS i INNER JOIN user AS u ON i.user_id = u.id"+
+			" WHERE i.issuer = ? AND i.subject = ? AND u.deleted_at IS NULL",
+		issuer, claims.Subject)
+	if err == nil {
+		return userID, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	userID = currentUserID
+	if userID == 0 {
+		if userID, err = provisionOIDCUser(claims); err != nil {
+			return 0, err
+		}
+	}
+	_, err = db.Exec(
+		"REPLACE INTO user_identity (issuer, subject, user_id, created_at) VALUES (?, ?, ?, NOW())",
+		issuer, claims.Subject, userID)
+	if err != nil {
+		return 0, err
+	}
+	return userID, nil
+}
+
+func provisionOIDCUser(claims *IDTokenClaims) (int64, error) {
+	base := claims.PreferredUsername
+	if base == "" && claims.Email != "" {
+		base = strings.SplitN(claims.Email, "@", 2)[0]
+	}
+	base = oidcUsernameRe.ReplaceAllString(base, "")
+	if base == "" || reservedUserName(base) {
+		base = "user"
+	}
+	displayName := claims.Name
+	if displayName == "" {
+		displayName = base
+	}
+
+	name := base
+	for i := 0; i < 5; i++ {
+		// ローカルのパスワードは持たない(空のハッシュはどの入力とも一致しない)
+		res, err := db.Exec(
+			"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
+				" VALUES (?, '', '', ?, ?, NOW())",
+			name, displayName, "default.png")
+		if err == nil {
+			userID, err := res.LastInsertId()
+			if err != nil {
+				return 0, err
+			}
+			setIdenticonAvatar(userID, name)
+			return userID, nil
+		}
+		if merr, ok := err.(*mysql.MySQLError); !ok || merr.Number != 1062 {
+			return 0, err
+		}
+		name = base + "-" + strings.ToLower(secureRandomString(4))
+	}
+	return 0, errors.New("could not allocate user name")
+}
+
+//request handlers
+
+func getLoginOIDC(c echo.Context) error {
+	p := getOIDCProvider()
+	if p == nil {
+		return echo.ErrNotFound
+	}
+
+	state := secureRandomString(32)
+	nonce := secureRandomString(32)
+	verifier := secureRandomString(64)
+	u, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get("session", c)
+	sess.Values["oidc_state"] = state
+	sess.Values["oidc_nonce"] = nonce
+	sess.Values["oidc_verifier"] = verifier
+	sess.Values["oidc_started_at"] = oidcNow().Unix()
+	// 再認証のときは元の画面へ戻す
+	if next := c.QueryParam("next"); isLocalPath(next) {
+		sess.Values["oidc_next"] = next
+	} else {
+		delete(sess.Values, "oidc_next")
+	}
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusFound, u)
+}
+
+func getLoginOIDCCallback(c echo.Context) error {
+	p := getOIDCProvider()
+	if p == nil {
+		return echo.ErrNotFound
+	}
+
+	sess, _ := session.Get("session", c)
+	state, _ := sess.Values["oidc_state"].(string)
+	nonce, _ := sess.Values["oidc_nonce"].(string)
+	verifier, _ := sess.Values["oidc_verifier"].(string)
+	startedAt, _ := sess.Values["oidc_started_at"].(int64)
+	next, _ := sess.Values["oidc_next"].(string)
+	delete(sess.Values, "oidc_state")
+	delete(sess.Values, "oidc_nonce")
+	delete(sess.Values, "oidc_verifier")
+	delete(sess.Values, "oidc_started_at")
+	delete(sess.Values, "oidc_next")
+
+	if c.QueryParam("error") != "" {
+		return echo.ErrForbidden
+	}
+	if state == "" || c.QueryParam("state") != state || oidcNow().Unix()-startedAt > oidcPendingTTL {
+		return ErrBadReqeust
+	}
+	code := c.QueryParam("code")
+	if code == "" {
+		return ErrBadReqeust
+	}
+
+	rawIDToken, err := p.Exchange(code, verifier)
+	if err != nil {
+		return err
+	}
+	claims, err := p.VerifyIDToken(rawIDToken, nonce)
+	if err != nil {
+		return echo.ErrForbidden
+	}
+
+	userID, err := findOrProvisionOIDCUser(p.Config.Issuer, claims, sessUserID(c))
+	if err != nil {
+		return err
+	}
+	// 2段階認証は IdP 側に任せる
+	sess.Values["oidc_authenticated_at"] = oidcNow().Unix()
+	sessSetUserID(c, userID)
+	if !isLocalPath(next) {
+		next = "/"
+	}
+	return c.Redirect(http.StatusSeeOther, next)
+}
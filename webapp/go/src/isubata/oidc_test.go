@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+
+	"isubata/fakeidp"
+)
+
+const testOIDCRedirectURL = "http://app.example/login/oidc/callback"
+
+func startFakeIDP(t *testing.T) (*fakeidp.Provider, *httptest.Server) {
+	t.Helper()
+	idp, err := fakeidp.New("isubata", "isubata-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(idp)
+	idp.Issuer = srv.URL
+	return idp, srv
+}
+
+// authorize は認可エンドポイントを叩き、コールバックに渡る code を返す
+func authorize(t *testing.T, authURL, state string) string {
+	t.Helper()
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize: status %d", res.StatusCode)
+	}
+	loc, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(loc.String(), testOIDCRedirectURL) {
+		t.Fatalf("redirected to %s", loc)
+	}
+	if loc.Query().Get("state") != state {
+		t.Fatalf("state = %q, want %q", loc.Query().Get("state"), state)
+	}
+	return loc.Query().Get("code")
+}
+
+func TestOIDCAuthorizationCodeFlow(t *testing.T) {
+	idp, srv := startFakeIDP(t)
+	defer srv.Close()
+	p := NewOIDCProvider(OIDCConfig{
+		Issuer:       srv.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  testOIDCRedirectURL,
+	})
+
+	state, nonce, verifier := "state-1", "nonce-1", secureRandomString(64)
+	authURL, err := p.AuthCodeURL(state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// PKCE の verifier が違えば交換できない。失敗したコードはもう使えない
+	code := authorize(t, authURL, state)
+	if _, err := p.Exchange(code, secureRandomString(64)); err == nil {
+		t.Fatal("exchanged with a wrong code_verifier")
+	}
+	if _, err := p.Exchange(code, verifier); err == nil {
+		t.Fatal("reused a code after a failed exchange")
+	}
+
+	code = authorize(t, authURL, state)
+	raw, err := p.Exchange(code, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Exchange(code, verifier); err == nil {
+		t.Fatal("exchanged a code twice")
+	}
+
+	if _, err := p.VerifyIDToken(raw, "other-nonce"); err != ErrInvalidIDToken {
+		t.Errorf("wrong nonce: err = %v", err)
+	}
+	claims, err := p.VerifyIDToken(raw, nonce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.Subject != idp.User.Subject || claims.PreferredUsername != idp.User.PreferredUsername {
+		t.Errorf("claims = %+v", claims)
+	}
+
+	// 期限切れ
+	defer func(f func() time.Time) { oidcNow = f }(oidcNow)
+	oidcNow = func() time.Time { return time.Now().Add(time.Hour) }
+	if _, err := p.VerifyIDToken(raw, nonce); err != ErrInvalidIDToken {
+		t.Errorf("expired token: err = %v", err)
+	}
+
+	// 別のクライアント向けのトークンは受け付けない
+	oidcNow = time.Now
+	other := NewOIDCProvider(OIDCConfig{Issuer: srv.URL, ClientID: "other", RedirectURL: testOIDCRedirectURL})
+	if _, err := other.VerifyIDToken(raw, nonce); err != ErrInvalidIDToken {
+		t.Errorf("wrong audience: err = %v", err)
+	}
+}
+
+// OIDC で作られたパスワードの無いユーザも、IdP で認証し直せばパスワードを設定できる
+func TestOIDCLoginAndReauth(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	idp, idpSrv := startFakeIDP(t)
+	defer idpSrv.Close()
+	suffix := fmt.Sprint(time.Now().UnixNano() % 1000000000)
+	idp.User.Subject = "subject-" + suffix
+	idp.User.PreferredUsername = "oidc" + suffix
+
+	dir, err := ioutil.TempDir("", "isubata-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s BlobStore) { iconStore = s }(iconStore)
+	iconStore = newLocalBlobStore(dir)
+
+	cfg, err := loadSessionConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := echo.New()
+	e.Use(session.Middleware(newSessionStore(cfg)))
+	e.GET("/login/oidc", getLoginOIDC)
+	e.GET("/login/oidc/callback", getLoginOIDCCallback)
+	e.POST("/account/password", postAccountPassword)
+	app := httptest.NewServer(e)
+	defer app.Close()
+
+	oidcOnce.Do(func() {})
+	defer func(p *OIDCProvider) { oidcInstance = p }(oidcInstance)
+	oidcInstance = NewOIDCProvider(OIDCConfig{
+		Issuer:       idpSrv.URL,
+		ClientID:     idp.ClientID,
+		ClientSecret: idp.ClientSecret,
+		RedirectURL:  app.URL + "/login/oidc/callback",
+	})
+
+	jar, _ := cookiejar.New(nil)
+	client := &http.Client{Jar: jar, CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		// IdP を経由してコールバックまではたどり、その後のリダイレクトは見るだけにする
+		if strings.HasPrefix(req.URL.String(), app.URL) && req.URL.Path != "/login/oidc/callback" {
+			return http.ErrUseLastResponse
+		}
+		return nil
+	}}
+
+	res, err := client.Get(app.URL + "/login/oidc?next=/account")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/account" {
+		t.Fatalf("callback: status %d, location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	var userID int64
+	err = db.Get(&userID, "SELECT user_id FROM user_identity WHERE issuer = ? AND subject = ?",
+		idpSrv.URL, idp.User.Subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM user_identity WHERE user_id = ?", userID)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	u, err := getUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Name != idp.User.PreferredUsername || u.Password != "" {
+		t.Fatalf("provisioned user = %+v", u)
+	}
+
+	setPassword := func() int {
+		form := url.Values{}
+		form.Set("new_password", "new-password")
+		form.Set("new_password_confirm", "new-password")
+		res, err := client.PostForm(app.URL+"/account/password", form)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	// IdP で認証してから時間が経つと、パスワードの代わりにはならない
+	defer func(f func() time.Time) { oidcNow = f }(oidcNow)
+	oidcNow = func() time.Time { return time.Now().Add((oidcReauthTTL + 1) * time.Second) }
+	if status := setPassword(); status != http.StatusForbidden {
+		t.Fatalf("stale reauth: status %d", status)
+	}
+
+	oidcNow = time.Now
+	if status := setPassword(); status != http.StatusSeeOther {
+		t.Fatalf("set password: status %d", status)
+	}
+	u, err = getUser(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := verifyPassword(u, "new-password"); err != nil || !ok {
+		t.Errorf("password was not set: ok = %v, err = %v", ok, err)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+const (
+	outgoingWebhookQueueKey = "OUTGOING-WEBHOOK-QUEUE"
+	// score は次に送る時刻(unix ms)
+	outgoingWebhookRetryKey = "OUTGOING-WEBHOOK-RETRY"
+	outgoingWebhookDeadKey  = "OUTGOING-WEBHOOK-DEAD"
+	outgoingWebhookLogKey   = "OUTGOING-WEBHOOK-LOG-"
+
+	outgoingWebhookWorkers     = 4
+	outgoingWebhookMaxAttempts = 6
+	outgoingWebhookLogSize     = 100
+	outgoingWebhookDeadSize    = 1000
+
+	maxOutgoingWebhooksPerChannel = 10
+	maxOutgoingWebhookURL         = 255
+	maxOutgoingWebhookTriggers    = 255
+
+	OutgoingResultOK    = "ok"
+	OutgoingResultRetry = "retry"
+	OutgoingResultDead  = "dead"
+)
+
+var (
+	// テストでは httptest のサーバに向けたり、待ち時間を縮めたりできるよう変数にしておく
+	// 登録された URL がループバックや社内のアドレスを指していても、接続する時点で断る
+	outgoingWebhookClient = func() *http.Client {
+		client := &http.Client{Timeout: 5 * time.Second}
+		if !allowPrivateWebhookTargets() {
+			client = newPublicHTTPClient(5 * time.Second)
+		}
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+		return client
+	}()
+	outgoingWebhookBackoff = func(attempt int) time.Duration {
+		d := 2 * time.Second << uint(attempt-1)
+		if d > 10*time.Minute {
+			d = 10 * time.Minute
+		}
+		return d
+	}
+)
+
+type OutgoingWebhook struct {
+	ID        int64  `db:"id"`
+	ChannelID int64  `db:"channel_id"`
+	Name      string `db:"name"`
+	URL       string `db:"url"`
+	// HMAC の鍵。作成時に一度だけ見せる
+	Secret string `db:"secret"`
+	// カンマ区切り。空ならすべてのメッセージを送る
+	TriggerWords string     `db:"trigger_words"`
+	CreatedBy    int64      `db:"created_by"`
+	CreatedAt    time.Time  `db:"created_at"`
+	RevokedAt    *time.Time `db:"revoked_at"`
+}
+
+// OutgoingWebhookPayload は受信側に POST する JSON
+type OutgoingWebhookPayload struct {
+	WebhookID   int64  `json:"webhook_id"`
+	ChannelID   int64  `json:"channel_id"`
+	ChannelName string `json:"channel_name"`
+	MessageID   int64  `json:"message_id"`
+	UserName    string `json:"user_name"`
+	DisplayName string `json:"display_name"`
+	Kind        string `json:"kind"`
+	Text        string `json:"text"`
+	TriggerWord string `json:"trigger_word,omitempty"`
+	Timestamp   int64  `json:"timestamp"`
+}
+
+// OutgoingWebhookJob はキューに積む1回分の配信。再送しても DeliveryID は変わらない
+type OutgoingWebhookJob struct {
+	DeliveryID string          `json:"delivery_id"`
+	WebhookID  int64           `json:"webhook_id"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempt    int             `json:"attempt"`
+	LastError  string          `json:"last_error,omitempty"`
+	EnqueuedAt int64           `json:"enqueued_at"`
+}
+
+// OutgoingWebhookLog は配信ログの1行
+type OutgoingWebhookLog struct {
+	DeliveryID string `json:"delivery_id"`
+	Attempt    int    `json:"attempt"`
+	StatusCode int    `json:"status_code"`
+	Error      string `json:"error,omitempty"`
+	Result     string `json:"result"`
+	DurationMs int64  `json:"duration_ms"`
+	At         int64  `json:"at"`
+}
+
+func (l OutgoingWebhookLog) Time() time.Time {
+	return time.Unix(l.At, 0)
+}
+
+// 時刻になった再送をキューに戻す。複数台で動いても1回だけ戻るよう Lua でまとめる
+var promoteRetryScript = redis.NewScript(2, `
+local jobs = redis.call('ZRANGEBYSCORE', KEYS[1], 0, ARGV[1], 'LIMIT', 0, 100)
+for _, job in ipairs(jobs) do
+  redis.call('ZREM', KEYS[1], job)
+  redis.call('LPUSH', KEYS[2], job)
+end
+return #jobs
+`)
+
+// signOutgoingWebhook は "<timestamp>.<body>" の HMAC-SHA256 を返す
+func signOutgoingWebhook(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func splitTriggerWords(s string) []string {
+	words := []string{}
+	for _, w := range strings.Split(s, ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+// matchTriggerWord はメッセージの先頭に一致したトリガーワードを返す
+func matchTriggerWord(hook OutgoingWebhook, content string) (string, bool) {
+	words := splitTriggerWords(hook.TriggerWords)
+	if len(words) == 0 {
+		return "", true
+	}
+	for _, w := range words {
+		if strings.HasPrefix(content, w) {
+			return w, true
+		}
+	}
+	return "", false
+}
+
+func validOutgoingWebhookURL(s string) bool {
+	if s == "" || len(s) > maxOutgoingWebhookURL {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return false
+	}
+	// 名前で指定されたものは送るときに確かめる
+	if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) && !allowPrivateWebhookTargets() {
+		return false
+	}
+	return true
+}
+
+func allowPrivateWebhookTargets() bool {
+	return os.Getenv("ISUBATA_WEBHOOK_ALLOW_PRIVATE") == "true"
+}
+
+func queryOutgoingWebhooks(chID int64) ([]OutgoingWebhook, error) {
+	hooks := []OutgoingWebhook{}
+	err := db.Select(&hooks, "SELECT * FROM outgoing_webhook WHERE channel_id = ? AND revoked_at IS NULL ORDER BY id", chID)
+	return hooks, err
+}
+
+func getOutgoingWebhook(id int64) (*OutgoingWebhook, error) {
+	h := OutgoingWebhook{}
+	if err := db.Get(&h, "SELECT * FROM outgoing_webhook WHERE id = ?", id); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+// enqueueOutgoingWebhooks は onMessageAdded から呼ばれ、条件に合う購読ごとにジョブを積む
+func enqueueOutgoingWebhooks(ch *ChannelInfo, m Message) error {
+	hooks, err := queryOutgoingWebhooks(ch.ID)
+	if err != nil || len(hooks) == 0 {
+		return err
+	}
+	user, err := getUser(m.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %d not found", m.UserID)
+	}
+
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for _, hook := range hooks {
+		word, ok := matchTriggerWord(hook, m.Content)
+		if !ok {
+			continue
+		}
+		payload, err := json.Marshal(OutgoingWebhookPayload{
+			WebhookID:   hook.ID,
+			ChannelID:   ch.ID,
+			ChannelName: ch.Name,
+			MessageID:   m.ID,
+			UserName:    user.Name,
+			DisplayName: user.DisplayName,
+			Kind:        m.Kind,
+			Text:        m.Content,
+			TriggerWord: word,
+			Timestamp:   m.CreatedAt.Unix(),
+		})
+		if err != nil {
+			return err
+		}
+		job := OutgoingWebhookJob{
+			DeliveryID: secureRandomString(20),
+			WebhookID:  hook.ID,
+			Payload:    payload,
+			EnqueuedAt: time.Now().Unix(),
+		}
+		if err := r.LPushListToCache(outgoingWebhookQueueKey, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendOutgoingWebhook は1回だけ POST する。2xx 以外はエラーにする
+func sendOutgoingWebhook(hook *OutgoingWebhook, job *OutgoingWebhookJob) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, hook.URL, bytes.NewReader(job.Payload))
+	if err != nil {
+		return 0, err
+	}
+	ts := time.Now().Unix()
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "isubata-webhook/1")
+	req.Header.Set("X-Isubata-Delivery", job.DeliveryID)
+	req.Header.Set("X-Isubata-Attempt", strconv.Itoa(job.Attempt))
+	req.Header.Set("X-Isubata-Timestamp", strconv.FormatInt(ts, 10))
+	req.Header.Set("X-Isubata-Signature", signOutgoingWebhook(hook.Secret, ts, job.Payload))
+
+	res, err := outgoingWebhookClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	// 接続を使い回せるよう読み捨てる
+	io.Copy(ioutil.Discard, io.LimitReader(res.Body, 64*1024))
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return res.StatusCode, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// processOutgoingWebhookJob は配信して結果をログに残し、失敗したら再送かデッドレターに回す
+func processOutgoingWebhookJob(r *Redisful, job OutgoingWebhookJob) error {
+	hook, err := getOutgoingWebhook(job.WebhookID)
+	if err != nil {
+		return err
+	}
+	// 無効にした購読の残りは捨てる
+	if hook == nil || hook.RevokedAt != nil {
+		return nil
+	}
+
+	job.Attempt++
+	start := time.Now()
+	status, sendErr := sendOutgoingWebhook(hook, &job)
+	entry := OutgoingWebhookLog{
+		DeliveryID: job.DeliveryID,
+		Attempt:    job.Attempt,
+		StatusCode: status,
+		Result:     OutgoingResultOK,
+		DurationMs: int64(time.Since(start) / time.Millisecond),
+		At:         start.Unix(),
+	}
+
+	if sendErr != nil {
+		job.LastError = sendErr.Error()
+		entry.Error = job.LastError
+		if job.Attempt >= outgoingWebhookMaxAttempts {
+			entry.Result = OutgoingResultDead
+			if err := r.LPushListToCache(outgoingWebhookDeadKey, job); err != nil {
+				return err
+			}
+			if _, err := r.Conn.Do("LTRIM", outgoingWebhookDeadKey, 0, outgoingWebhookDeadSize-1); err != nil {
+				return err
+			}
+		} else {
+			entry.Result = OutgoingResultRetry
+			data, err := json.Marshal(job)
+			if err != nil {
+				return err
+			}
+			next := time.Now().Add(outgoingWebhookBackoff(job.Attempt))
+			if _, err := r.Conn.Do("ZADD", outgoingWebhookRetryKey, next.UnixNano()/int64(time.Millisecond), data); err != nil {
+				return err
+			}
+		}
+	}
+
+	key := outgoingWebhookLogKey + strconv.FormatInt(hook.ID, 10)
+	if err := r.LPushListToCache(key, entry); err != nil {
+		return err
+	}
+	_, err = r.Conn.Do("LTRIM", key, 0, outgoingWebhookLogSize-1)
+	return err
+}
+
+func queryOutgoingWebhookLogs(hookID int64) ([]OutgoingWebhookLog, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	items, err := redis.ByteSlices(r.Conn.Do("LRANGE", outgoingWebhookLogKey+strconv.FormatInt(hookID, 10), 0, -1))
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]OutgoingWebhookLog, 0, len(items))
+	for _, item := range items {
+		var l OutgoingWebhookLog
+		if err := json.Unmarshal(item, &l); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, nil
+}
+
+// runOutgoingWebhookWorker はキューから1件ずつ取り出して配信する。プロセスごとに複数起動してよい
+func runOutgoingWebhookWorker() {
+	for {
+		if err := drainOutgoingWebhookQueue(); err != nil {
+			log.Println(err, "IN runOutgoingWebhookWorker")
+			time.Sleep(time.Second)
+		}
+	}
+}
+
+func drainOutgoingWebhookQueue() error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	for {
+		reply, err := redis.ByteSlices(r.Conn.Do("BRPOP", outgoingWebhookQueueKey, 1))
+		if err == redis.ErrNil {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var job OutgoingWebhookJob
+		if err := json.Unmarshal(reply[1], &job); err != nil {
+			log.Printf("broken outgoing webhook job: %v", err)
+			continue
+		}
+		if err := processOutgoingWebhookJob(r, job); err != nil {
+			return err
+		}
+	}
+}
+
+// runOutgoingWebhookRetrier は時刻になった再送をキューに戻す
+func runOutgoingWebhookRetrier() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := promoteDueOutgoingWebhooks(time.Now()); err != nil {
+			log.Println(err, "IN runOutgoingWebhookRetrier")
+		}
+	}
+}
+
+func promoteDueOutgoingWebhooks(now time.Time) (int, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return redis.Int(promoteRetryScript.Do(r.Conn, outgoingWebhookRetryKey, outgoingWebhookQueueKey,
+		now.UnixNano()/int64(time.Millisecond)))
+}
+
+func startOutgoingWebhookWorkers() {
+	for i := 0; i < outgoingWebhookWorkers; i++ {
+		go runOutgoingWebhookWorker()
+	}
+	go runOutgoingWebhookRetrier()
+}
+
+func ensureOutgoingWebhook(c echo.Context) (*User, *ChannelInfo, *OutgoingWebhook, error) {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return nil, nil, nil, err
+	}
+	hookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return nil, nil, nil, ErrBadReqeust
+	}
+	hook, err := getOutgoingWebhook(hookID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if hook == nil || hook.ChannelID != ch.ID {
+		return nil, nil, nil, echo.ErrNotFound
+	}
+	return self, ch, hook, nil
+}
+
+//request handlers
+
+func postOutgoingWebhook(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	hookURL := strings.TrimSpace(c.FormValue("url"))
+	triggers := strings.Join(splitTriggerWords(c.FormValue("trigger_words")), ",")
+	if name == "" || utf8.RuneCountInString(name) > maxWebhookName ||
+		!validOutgoingWebhookURL(hookURL) || utf8.RuneCountInString(triggers) > maxOutgoingWebhookTriggers {
+		return ErrBadReqeust
+	}
+	hooks, err := queryOutgoingWebhooks(ch.ID)
+	if err != nil {
+		return err
+	}
+	if len(hooks) >= maxOutgoingWebhooksPerChannel {
+		return ErrBadReqeust
+	}
+
+	secret := secureRandomString(40)
+	_, err = db.Exec("INSERT INTO outgoing_webhook (channel_id, name, url, secret, trigger_words, created_by, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, NOW())",
+		ch.ID, name, hookURL, secret, triggers, self.ID)
+	if err != nil {
+		return err
+	}
+	return renderEditChannel(c, self, ch, map[string]interface{}{
+		"NewOutgoingWebhookSecret": secret,
+	})
+}
+
+func postRevokeOutgoingWebhook(c echo.Context) error {
+	self, ch, hook, err := ensureOutgoingWebhook(c)
+	if self == nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE outgoing_webhook SET revoked_at = NOW() WHERE id = ? AND revoked_at IS NULL", hook.ID)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v/edit", ch.ID))
+}
+
+func getOutgoingWebhookDeliveries(c echo.Context) error {
+	self, ch, hook, err := ensureOutgoingWebhook(c)
+	if self == nil {
+		return err
+	}
+
+	logs, err := queryOutgoingWebhookLogs(hook.ID)
+	if err != nil {
+		return err
+	}
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "outgoing_webhook", map[string]interface{}{
+		"ChannelID": ch.ID,
+		"Sidebar":   sidebar,
+		"User":      self,
+		"Channel":   ch,
+		"Webhook":   hook,
+		"Logs":      logs,
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+
+	"isubata/hookrecv"
+)
+
+// useLoopbackWebhookClient は httptest の受信側に送れるよう、接続先を制限しないクライアントにする
+func useLoopbackWebhookClient() func() {
+	prev := outgoingWebhookClient
+	outgoingWebhookClient = &http.Client{Timeout: 5 * time.Second}
+	return func() { outgoingWebhookClient = prev }
+}
+
+func TestSendOutgoingWebhookSignature(t *testing.T) {
+	rv := hookrecv.New("s3cret")
+	srv := httptest.NewServer(rv)
+	defer srv.Close()
+
+	hook := &OutgoingWebhook{ID: 1, URL: srv.URL, Secret: "s3cret"}
+	job := &OutgoingWebhookJob{DeliveryID: "delivery-1", Attempt: 1, Payload: json.RawMessage(`{"text":"hello"}`)}
+
+	// 既定のクライアントはループバックに送らない
+	if _, err := sendOutgoingWebhook(hook, job); err == nil || !strings.Contains(err.Error(), errNonPublicAddress.Error()) {
+		t.Fatalf("sent to a loopback address: err = %v", err)
+	}
+	if rv.Requests() != 0 {
+		t.Fatalf("receiver got %d requests", rv.Requests())
+	}
+
+	defer useLoopbackWebhookClient()()
+	status, err := sendOutgoingWebhook(hook, job)
+	if err != nil || status != http.StatusNoContent {
+		t.Fatalf("status = %d, err = %v", status, err)
+	}
+	ds := rv.Deliveries()
+	if len(ds) != 1 || ds[0].ID != "delivery-1" || ds[0].Attempt != 1 || ds[0].Payload["text"] != "hello" {
+		t.Fatalf("deliveries = %+v", ds)
+	}
+
+	// 鍵が違えば受信側が拒否する
+	hook.Secret = "other"
+	if status, err := sendOutgoingWebhook(hook, job); err == nil || status != http.StatusUnauthorized {
+		t.Errorf("wrong secret: status = %d, err = %v", status, err)
+	}
+	if sig := signOutgoingWebhook("s3cret", 1500000000, []byte("{}")); sig != hookrecv.Sign("s3cret", 1500000000, []byte("{}")) {
+		t.Errorf("signature = %s", sig)
+	}
+}
+
+func TestValidOutgoingWebhookURL(t *testing.T) {
+	cases := map[string]bool{
+		"https://example.com/hook":     true,
+		"http://example.com/hook":      true,
+		"ftp://example.com/hook":       false,
+		"http://127.0.0.1:8080/hook":   false,
+		"http://[::1]/hook":            false,
+		"http://169.254.169.254/":      false,
+		"http://10.0.0.1/hook":         false,
+		"https://203.0.113.1.nip.io/x": true,
+	}
+	for u, want := range cases {
+		if got := validOutgoingWebhookURL(u); got != want {
+			t.Errorf("validOutgoingWebhookURL(%q) = %v, want %v", u, got, want)
+		}
+	}
+}
+
+func insertTestOutgoingWebhook(t *testing.T, url, secret string) int64 {
+	t.Helper()
+	res, err := db.Exec("INSERT INTO outgoing_webhook (channel_id, name, url, secret, created_by, created_at)"+
+		" VALUES (0, 'test', ?, ?, 0, NOW())", url, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	return id
+}
+
+// takeRetry は再送待ちから deliveryID のジョブを取り出し、送る予定の時刻と一緒に返す
+func takeRetry(t *testing.T, r *Redisful, deliveryID string) (OutgoingWebhookJob, time.Time) {
+	t.Helper()
+	items, err := redis.Strings(r.Conn.Do("ZRANGE", outgoingWebhookRetryKey, 0, -1, "WITHSCORES"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(items); i += 2 {
+		var job OutgoingWebhookJob
+		if json.Unmarshal([]byte(items[i]), &job) != nil || job.DeliveryID != deliveryID {
+			continue
+		}
+		r.Conn.Do("ZREM", outgoingWebhookRetryKey, items[i])
+		ms, _ := strconv.ParseInt(items[i+1], 10, 64)
+		return job, time.Unix(0, ms*int64(time.Millisecond))
+	}
+	t.Fatalf("delivery %s is not waiting for a retry", deliveryID)
+	return OutgoingWebhookJob{}, time.Time{}
+}
+
+func TestOutgoingWebhookRetryAndDeadLetter(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+	defer useLoopbackWebhookClient()()
+	// 待ち時間が使われていることを確かめられるよう、回数ごとに1分ずつ延ばす
+	defer func(f func(int) time.Duration) { outgoingWebhookBackoff = f }(outgoingWebhookBackoff)
+	outgoingWebhookBackoff = func(attempt int) time.Duration { return time.Duration(attempt) * time.Minute }
+
+	r, err := NewRedisful()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// 2回失敗してから届く
+	flaky := hookrecv.New("flaky-secret")
+	flaky.FailFirst = 2
+	flakySrv := httptest.NewServer(flaky)
+	defer flakySrv.Close()
+	flakyID := insertTestOutgoingWebhook(t, flakySrv.URL, "flaky-secret")
+	defer db.Exec("DELETE FROM outgoing_webhook WHERE id = ?", flakyID)
+	defer r.Conn.Do("DEL", outgoingWebhookLogKey+strconv.FormatInt(flakyID, 10))
+
+	job := OutgoingWebhookJob{DeliveryID: secureRandomString(20), WebhookID: flakyID, Payload: json.RawMessage(`{"text":"deploy"}`)}
+	for attempt := 1; attempt <= 2; attempt++ {
+		before := time.Now()
+		if err := processOutgoingWebhookJob(r, job); err != nil {
+			t.Fatal(err)
+		}
+		var next time.Time
+		job, next = takeRetry(t, r, job.DeliveryID)
+		if job.Attempt != attempt || job.LastError == "" {
+			t.Fatalf("attempt %d: job = %+v", attempt, job)
+		}
+		wait := time.Duration(attempt) * time.Minute
+		if next.Before(before.Add(wait).Add(-time.Second)) || next.After(time.Now().Add(wait).Add(time.Second)) {
+			t.Errorf("attempt %d: retry at %v, want about %v later", attempt, next, wait)
+		}
+	}
+	if err := processOutgoingWebhookJob(r, job); err != nil {
+		t.Fatal(err)
+	}
+	ds := flaky.Deliveries()
+	if len(ds) != 1 || ds[0].ID != job.DeliveryID || ds[0].Attempt != 3 {
+		t.Fatalf("deliveries = %+v", ds)
+	}
+	logs, err := queryOutgoingWebhookLogs(flakyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	results := []string{}
+	for _, l := range logs {
+		results = append(results, l.Result)
+	}
+	if strings.Join(results, ",") != "ok,retry,retry" {
+		t.Errorf("log results = %v", results)
+	}
+
+	// 受信側がずっと失敗するとデッドレターに移る
+	down := hookrecv.New("down-secret")
+	down.FailFirst = outgoingWebhookMaxAttempts
+	downSrv := httptest.NewServer(down)
+	defer downSrv.Close()
+	downID := insertTestOutgoingWebhook(t, downSrv.URL, "down-secret")
+	defer db.Exec("DELETE FROM outgoing_webhook WHERE id = ?", downID)
+	defer r.Conn.Do("DEL", outgoingWebhookLogKey+strconv.FormatInt(downID, 10))
+
+	job = OutgoingWebhookJob{DeliveryID: secureRandomString(20), WebhookID: downID, Payload: json.RawMessage(`{"text":"deploy"}`)}
+	for attempt := 1; attempt < outgoingWebhookMaxAttempts; attempt++ {
+		if err := processOutgoingWebhookJob(r, job); err != nil {
+			t.Fatal(err)
+		}
+		job, _ = takeRetry(t, r, job.DeliveryID)
+	}
+	if err := processOutgoingWebhookJob(r, job); err != nil {
+		t.Fatal(err)
+	}
+	if down.Requests() != outgoingWebhookMaxAttempts {
+		t.Errorf("requests = %d, want %d", down.Requests(), outgoingWebhookMaxAttempts)
+	}
+	dead, err := redis.Strings(r.Conn.Do("LRANGE", outgoingWebhookDeadKey, 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, item := range dead {
+		var j OutgoingWebhookJob
+		if json.Unmarshal([]byte(item), &j) == nil && j.DeliveryID == job.DeliveryID {
+			found = j.Attempt == outgoingWebhookMaxAttempts
+			r.Conn.Do("LREM", outgoingWebhookDeadKey, 0, item)
+		}
+	}
+	if !found {
+		t.Error("job was not dead-lettered after the last attempt")
+	}
+	logs, _ = queryOutgoingWebhookLogs(downID)
+	if len(logs) != outgoingWebhookMaxAttempts || logs[0].Result != OutgoingResultDead {
+		t.Errorf("logs = %+v", logs)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// user.password には "<scheme>$<hash>" の形式で保存する
+// prefix のない40文字の hex は旧来の sha1(salt+password)
+const (
+	passwordSchemeSep = "$"
+	legacySHA1Scheme  = "sha1"
+	bcryptScheme      = "bcrypt"
+)
+
+var (
+	ErrUnknownPasswordScheme = errors.New("unknown password scheme")
+
+	passwordHashers       = map[string]PasswordHasher{}
+	defaultPasswordHasher PasswordHasher
+)
+
+type PasswordHasher interface {
+	Scheme() string
+	Hash(password string) (string, error)
+	Verify(hash, password string) bool
+	// パラメータ(cost 等)が現在の設定と異なる場合 true
+	NeedsRehash(hash string) bool
+}
+
+func init() {
+	cost := bcrypt.DefaultCost
+	if s := os.Getenv("ISUBATA_BCRYPT_COST"); s != "" {
+		c, err := strconv.Atoi(s)
+		if err != nil || c < bcrypt.MinCost || c > bcrypt.MaxCost {
+			log.Fatalf("invalid ISUBATA_BCRYPT_COST: %q", s)
+		}
+		cost = c
+	}
+	RegisterPasswordHasher(&bcryptHasher{cost: cost})
+	defaultPasswordHasher = passwordHashers[bcryptScheme]
+}
+
+func RegisterPasswordHasher(h PasswordHasher) {
+	passwordHashers[h.Scheme()] = h
+}
+
+func splitPasswordHash(stored string) (scheme, hash string) {
+	pos := strings.Index(stored, passwordSchemeSep)
+	if pos < 0 {
+		return legacySHA1Scheme, stored
+	}
+	return stored[:pos], stored[pos+1:]
+}
+
+func hashPassword(password string) (string, error) {
+	hash, err := defaultPasswordHasher.Hash(password)
+	if err != nil {
+		return "", err
+	}
+	return defaultPasswordHasher.Scheme() + passwordSchemeSep + hash, nil
+}
+
+// verifyPassword は照合結果と、デフォルトの方式で再ハッシュすべきかを返す
+func verifyPassword(u *User, password string) (ok bool, rehash bool, err error) {
+	scheme, hash := splitPasswordHash(u.Password)
+	if scheme == legacySHA1Scheme {
+		return verifyLegacySHA1(u.Salt, hash, password), true, nil
+	}
+
+	h, found := passwordHashers[scheme]
+	if !found {
+		return false, false, ErrUnknownPasswordScheme
+	}
+	if !h.Verify(hash, password) {
+		return false, false, nil
+	}
+	return true, h != defaultPasswordHasher || h.NeedsRehash(hash), nil
+}
+
+func verifyLegacySHA1(salt, digest, password string) bool {
+	expected := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(digest)) == 1
+}
+
+// ログイン成功時に古い形式のハッシュを置き換える
+func rehashPassword(userID int64, password string) error {
+	hash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("UPDATE user SET salt = '', password = ? WHERE id = ?", hash, userID)
+	return err
+}
+
+type bcryptHasher struct {
+	cost int
+}
+
+func (h *bcryptHasher) Scheme() string {
+	return bcryptScheme
+}
+
+func (h *bcryptHasher) Hash(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), h.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (h *bcryptHasher) Verify(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func (h *bcryptHasher) NeedsRehash(hash string) bool {
+	cost, err := bcrypt.Cost([]byte(hash))
+	return err != nil || cost != h.cost
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo"
+)
+
+const (
+	maxPinsPerChannel = 50
+	maxSavedMessages  = 100
+)
+
+// SavedMessage は保存したメッセージとそのチャンネル名
+type SavedMessage struct {
+	Message
+	ChannelName string
+}
+
+func getMessageByID(mID int64) (*Message, error) {
+	m := Message{}
+	if err := db.Get(&m, "SELECT * FROM message WHERE id = ?", mID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &m, nil
+}
+
+// queryPinnedMessages は新しくピン留めしたものから返す
+// メッセージが消えたピンは JOIN で落ちる
+func queryPinnedMessages(chID int64) ([]Message, error) {
+	rows, err := db.Query("SELECT "+messageWithUserColumns+" FROM pinned_message AS p"+
+		" INNER JOIN message AS m ON m.id = p.message_id AND m.channel_id = p.channel_id"+
+		" INNER JOIN user AS u ON m.user_id = u.id"+
+		" WHERE p.channel_id = ? ORDER BY p.created_at DESC, p.message_id DESC", chID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []Message{}
+	for rows.Next() {
+		m, err := scanMessageWithUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, m)
+	}
+	return msgs, rows.Err()
+}
+
+// querySavedMessages はメッセージかチャンネルが消えたものを除いて返す
+func querySavedMessages(userID int64) ([]SavedMessage, error) {
+	rows, err := db.Query("SELECT "+messageWithUserColumns+", c.name FROM saved_message AS s"+
+		" INNER JOIN message AS m ON m.id = s.message_id"+
+		" INNER JOIN channel AS c ON c.id = m.channel_id"+
+		" INNER JOIN user AS u ON m.user_id = u.id"+
+		" WHERE s.user_id = ? ORDER BY s.created_at DESC, s.message_id DESC LIMIT ?", userID, maxSavedMessages)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []SavedMessage{}
+	for rows.Next() {
+		var name string
+		m, err := scanMessageWithUser(rows, &name)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, SavedMessage{Message: m, ChannelName: name})
+	}
+	return msgs, rows.Err()
+}
+
+func jsonifySavedMessage(m SavedMessage) map[string]interface{} {
+	r := jsonifyMessageWithUser(m.Message)
+	r["channel_id"] = m.ChannelID
+	r["channel_name"] = m.ChannelName
+	return r
+}
+
+func isDuplicateEntry(err error) bool {
+	merr, ok := err.(*mysql.MySQLError)
+	return ok && merr.Number == 1062
+}
+
+// ensurePinnableChannel はピン留めを変更できるユーザとチャンネルを返す
+// アーカイブ済みのチャンネルは投稿と同じく変更できない
+func ensurePinnableChannel(c echo.Context) (*User, *ChannelInfo, error) {
+	user, err := ensureLogin(c)
+	if user == nil {
+		return nil, nil, err
+	}
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return nil, nil, ErrBadReqeust
+	}
+	ch, err := getChannelInfo(chID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ch == nil {
+		return nil, nil, echo.ErrNotFound
+	}
+	if err := requireChannelPermission(user, ch, PermPostMessage); err != nil {
+		return nil, nil, err
+	}
+	return user, ch, nil
+}
+
+//request handlers
+
+func getPins(c echo.Context) error {
+	if sessUserID(c) == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return ErrBadReqeust
+	}
+
+	msgs, err := queryPinnedMessages(chID)
+	if err != nil {
+		return err
+	}
+	res := make([]map[string]interface{}, 0, len(msgs))
+	for _, m := range msgs {
+		res = append(res, jsonifyMessageWithUser(m))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func postPin(c echo.Context) error {
+	user, ch, err := ensurePinnableChannel(c)
+	if user == nil {
+		return err
+	}
+
+	mID, err := strconv.ParseInt(c.FormValue("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	m, err := getMessageByID(mID)
+	if err != nil {
+		return err
+	}
+	if m == nil || m.ChannelID != ch.ID {
+		return echo.ErrNotFound
+	}
+
+	var cnt int64
+	if err := db.Get(&cnt, "SELECT COUNT(*) FROM pinned_message WHERE channel_id = ?", ch.ID); err != nil {
+		return err
+	}
+	if cnt >= maxPinsPerChannel {
+		return ErrBadReqeust
+	}
+
+	_, err = db.Exec("INSERT INTO pinned_message (channel_id, message_id, pinned_by, created_at) VALUES (?, ?, ?, NOW())",
+		ch.ID, m.ID, user.ID)
+	if err != nil && !isDuplicateEntry(err) {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postUnpin(c echo.Context) error {
+	user, ch, err := ensurePinnableChannel(c)
+	if user == nil {
+		return err
+	}
+
+	mID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if _, err := db.Exec("DELETE FROM pinned_message WHERE channel_id = ? AND message_id = ?", ch.ID, mID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getSaved(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	msgs, err := querySavedMessages(self.ID)
+	if err != nil {
+		return err
+	}
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "saved", map[string]interface{}{
+		"ChannelID": 0,
+		"Sidebar":   sidebar,
+		"User":      self,
+		"Messages":  msgs,
+	})
+}
+
+func getSavedMessages(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	msgs, err := querySavedMessages(userID)
+	if err != nil {
+		return err
+	}
+	res := make([]map[string]interface{}, 0, len(msgs))
+	for _, m := range msgs {
+		res = append(res, jsonifySavedMessage(m))
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+func postSavedMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	mID, err := strconv.ParseInt(c.FormValue("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	m, err := getMessageByID(mID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return echo.ErrNotFound
+	}
+
+	_, err = db.Exec("INSERT INTO saved_message (user_id, message_id, created_at) VALUES (?, ?, NOW())",
+		userID, m.ID)
+	if err != nil && !isDuplicateEntry(err) {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postUnsaveMessage(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	mID, err := strconv.ParseInt(c.Param("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	if _, err := db.Exec("DELETE FROM saved_message WHERE user_id = ? AND message_id = ?", userID, mID); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo"
+)
+
+// 在席と入力中はチャンネルごとの sorted set に、期限(ミリ秒)を score にして user_id を入れる
+// (user, channel) ごとに期限が切れ、どの台が書いたものも同じように読める
+const (
+	presenceKeyPrefix = "PRESENCE-"
+	typingKeyPrefix   = "TYPING-"
+	// user_id => 最後に heartbeat か入力をした unix 秒
+	lastSeenKey = "LAST-SEEN"
+
+	// クライアント(presence.js)は3秒ごとに送る。何回か取りこぼしても消えないようにする
+	presenceTTL = 30 * time.Second
+	typingTTL   = 6 * time.Second
+)
+
+func presenceKey(chID int64) string {
+	return presenceKeyPrefix + strconv.FormatInt(chID, 10)
+}
+
+func typingKey(chID int64) string {
+	return typingKeyPrefix + strconv.FormatInt(chID, 10)
+}
+
+func unixMilli(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// touchPresence は key に userID を ttl の間入れ、期限の切れたものを消す
+func touchPresence(key string, userID int64, ttl time.Duration, now time.Time) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	r.Conn.Send("MULTI")
+	r.Conn.Send("ZADD", key, unixMilli(now.Add(ttl)), userID)
+	r.Conn.Send("ZREMRANGEBYSCORE", key, "-inf", unixMilli(now))
+	// 誰も来なくなったチャンネルのキーは残さない
+	r.Conn.Send("EXPIRE", key, int(ttl/time.Second)+1)
+	r.Conn.Send("HSET", lastSeenKey, userID, now.Unix())
+	_, err = r.Conn.Do("EXEC")
+	return err
+}
+
+func clearTyping(chID, userID int64) {
+	r, err := NewRedisful()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	if _, err := r.Conn.Do("ZREM", typingKey(chID), userID); err != nil {
+		log.Println(err, "IN clearTyping")
+	}
+}
+
+// activeUserIDs は key のうち期限が切れていない user_id を返す
+func activeUserIDs(key string, now time.Time) ([]int64, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return redis.Int64s(r.Conn.Do("ZRANGEBYSCORE", key, unixMilli(now), "+inf"))
+}
+
+// getLastSeen は最後に見かけた時刻を返す。記録が無ければ nil
+func getLastSeen(userID int64) (*time.Time, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	sec, err := redis.Int64(r.Conn.Do("HGET", lastSeenKey, userID))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(sec, 0)
+	return &t, nil
+}
+
+// queryUsersByIDs は ids の順に並べて返す。消えたユーザは飛ばす
+func queryUsersByIDs(ids []int64) ([]User, error) {
+	if len(ids) == 0 {
+		return []User{}, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM user WHERE id IN (?) AND deleted_at IS NULL", ids)
+	if err != nil {
+		return nil, err
+	}
+	found := []User{}
+	if err := db.Select(&found, query, args...); err != nil {
+		return nil, err
+	}
+	byID := make(map[int64]User, len(found))
+	for _, u := range found {
+		byID[u.ID] = u
+	}
+	users := make([]User, 0, len(found))
+	for _, id := range ids {
+		if u, ok := byID[id]; ok {
+			users = append(users, u)
+		}
+	}
+	return users, nil
+}
+
+// channelPresence は在席しているユーザと、自分以外の入力中のユーザを返す
+func channelPresence(chID, selfID int64, now time.Time) (map[string]interface{}, error) {
+	onlineIDs, err := activeUserIDs(presenceKey(chID), now)
+	if err != nil {
+		return nil, err
+	}
+	typingIDs, err := activeUserIDs(typingKey(chID), now)
+	if err != nil {
+		return nil, err
+	}
+	others := []int64{}
+	for _, id := range typingIDs {
+		if id != selfID {
+			others = append(others, id)
+		}
+	}
+	online, err := queryUsersByIDs(onlineIDs)
+	if err != nil {
+		return nil, err
+	}
+	typing, err := queryUsersByIDs(others)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"channel_id": chID,
+		"online":     online,
+		"typing":     typing,
+	}, nil
+}
+
+// presenceChannel は :channel_id のチャンネルを引く
+func presenceChannel(c echo.Context) (*ChannelInfo, error) {
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil {
+		return nil, echo.ErrNotFound
+	}
+	ch, err := getChannelInfo(chID)
+	if err != nil {
+		return nil, err
+	}
+	if ch == nil {
+		return nil, echo.ErrNotFound
+	}
+	return ch, nil
+}
+
+//request handlers
+
+// postPresence は heartbeat。開いているチャンネルに在席していることを記録し、今の在席と入力中を返す
+func postPresence(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	ch, err := presenceChannel(c)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := touchPresence(presenceKey(ch.ID), self.ID, presenceTTL, now); err != nil {
+		return err
+	}
+	res, err := channelPresence(ch.ID, self.ID, now)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, res)
+}
+
+// postTyping は入力中であることを記録する。クライアントは数秒に1回だけ送る
+func postTyping(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+	ch, err := presenceChannel(c)
+	if err != nil {
+		return err
+	}
+	if err := requireChannelPermission(self, ch, PermPostMessage); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := touchPresence(typingKey(ch.ID), self.ID, typingTTL, now); err != nil {
+		return err
+	}
+	// 入力しているなら在席もしている
+	if err := touchPresence(presenceKey(ch.ID), self.ID, presenceTTL, now); err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
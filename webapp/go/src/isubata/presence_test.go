@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+func clearPresence(chID int64, userIDs ...int64) {
+	r, err := NewRedisful()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	r.Conn.Do("DEL", presenceKey(chID), typingKey(chID))
+	for _, id := range userIDs {
+		r.Conn.Do("HDEL", lastSeenKey, id)
+	}
+}
+
+func userIDsOf(v interface{}) []int64 {
+	ids := []int64{}
+	for _, u := range v.([]User) {
+		ids = append(ids, u.ID)
+	}
+	return ids
+}
+
+// JSON には id が出ないので name で比べる
+func userNamesOf(users []User) []string {
+	names := []string{}
+	for _, u := range users {
+		names = append(names, u.Name)
+	}
+	return names
+}
+
+// 在席は presenceTTL、入力中は typingTTL を過ぎると一覧から消える
+func TestPresenceExpires(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("presence")
+	aliceID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", aliceID)
+	bobID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", bobID)
+	chID := insertTestChannel(t, name, aliceID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer clearPresence(chID, aliceID, bobID)
+
+	now := time.Now()
+	if err := touchPresence(presenceKey(chID), aliceID, presenceTTL, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := touchPresence(typingKey(chID), aliceID, typingTTL, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := touchPresence(presenceKey(chID), bobID, presenceTTL, now.Add(10*time.Second)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		at     time.Duration
+		online []int64
+		typing []int64
+	}{
+		{0, []int64{aliceID, bobID}, []int64{aliceID}},
+		{typingTTL - time.Millisecond, []int64{aliceID, bobID}, []int64{aliceID}},
+		{typingTTL + time.Millisecond, []int64{aliceID, bobID}, []int64{}},
+		{presenceTTL - time.Millisecond, []int64{aliceID, bobID}, []int64{}},
+		{presenceTTL + time.Millisecond, []int64{bobID}, []int64{}},
+		{presenceTTL + time.Minute, []int64{}, []int64{}},
+	}
+	for _, tt := range tests {
+		res, err := channelPresence(chID, bobID, now.Add(tt.at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := userIDsOf(res["online"]); fmt.Sprint(got) != fmt.Sprint(tt.online) {
+			t.Errorf("+%v: online = %v, want %v", tt.at, got, tt.online)
+		}
+		if got := userIDsOf(res["typing"]); fmt.Sprint(got) != fmt.Sprint(tt.typing) {
+			t.Errorf("+%v: typing = %v, want %v", tt.at, got, tt.typing)
+		}
+	}
+
+	// 自分の入力中は返さない
+	res, err := channelPresence(chID, aliceID, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := userIDsOf(res["typing"]); len(got) != 0 {
+		t.Errorf("self typing = %v", got)
+	}
+
+	// 期限の切れたものは次に書いたときに消え、キー自体にも期限が付く
+	if err := touchPresence(presenceKey(chID), bobID, presenceTTL, now.Add(presenceTTL+time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRedisful()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	members, err := redis.Int64s(r.Conn.Do("ZRANGE", presenceKey(chID), 0, -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(members) != fmt.Sprint([]int64{bobID}) {
+		t.Errorf("members = %v", members)
+	}
+	ttl, err := redis.Int(r.Conn.Do("TTL", presenceKey(chID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > int(presenceTTL/time.Second)+1 {
+		t.Errorf("key TTL = %d", ttl)
+	}
+}
+
+// 最後に見かけた時刻は在席が切れても残る
+func TestLastSeenPersisted(t *testing.T) {
+	requireRedis(t)
+
+	chID := time.Now().UnixNano()
+	userID := -chID
+	defer clearPresence(chID, userID)
+
+	if seen, err := getLastSeen(userID); err != nil || seen != nil {
+		t.Fatalf("unknown user: %v, %v", seen, err)
+	}
+
+	now := time.Now().Add(-time.Hour)
+	if err := touchPresence(presenceKey(chID), userID, presenceTTL, now); err != nil {
+		t.Fatal(err)
+	}
+	ids, err := activeUserIDs(presenceKey(chID), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("still online: %v", ids)
+	}
+	seen, err := getLastSeen(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen == nil || seen.Unix() != now.Unix() {
+		t.Errorf("last seen = %v, want %v", seen, now.Unix())
+	}
+
+	r, err := NewRedisful()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ttl, err := redis.Int(r.Conn.Do("TTL", lastSeenKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl != -1 {
+		t.Errorf("%s TTL = %d", lastSeenKey, ttl)
+	}
+}
+
+// 別の台に来た heartbeat と入力中も同じ一覧に出る
+func TestPresenceAcrossInstances(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("presence")
+	aliceID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", aliceID)
+	bobID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", bobID)
+	chID := insertTestChannel(t, name, aliceID)
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer clearPresence(chID, aliceID, bobID)
+
+	e1, app1 := newTestApp(t)
+	defer app1.Close()
+	e1.POST("/channel/:channel_id/presence", postPresence)
+	e1.POST("/channel/:channel_id/typing", postTyping)
+	e2, app2 := newTestApp(t)
+	defer app2.Close()
+	e2.POST("/channel/:channel_id/presence", postPresence)
+	e2.POST("/channel/:channel_id/typing", postTyping)
+
+	alice := newTestClient(t, app1, aliceID)
+	bob := newTestClient(t, app2, bobID)
+
+	res, err := alice.Post(fmt.Sprintf("%s/channel/%d/typing", app1.URL, chID), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Fatalf("typing: status = %d", res.StatusCode)
+	}
+
+	res, err = bob.Post(fmt.Sprintf("%s/channel/%d/presence", app2.URL, chID), "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("presence: status = %d", res.StatusCode)
+	}
+	var body struct {
+		Online []User `json:"online"`
+		Typing []User `json:"typing"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if got := userNamesOf(body.Online); fmt.Sprint(got) != fmt.Sprint([]string{name, name + "x"}) {
+		t.Errorf("online = %v", got)
+	}
+	if got := userNamesOf(body.Typing); fmt.Sprint(got) != fmt.Sprint([]string{name}) {
+		t.Errorf("typing = %v", got)
+	}
+
+	if seen, err := getLastSeen(bobID); err != nil || seen == nil {
+		t.Errorf("bob last seen = %v, %v", seen, err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+const (
+	rateLimitPrefix    = "RATE-LIMIT-"
+	loginFailurePrefix = "LOGIN-FAILURE-"
+)
+
+// 直近 window 内のリクエストを sorted set に持つ sliding window
+// 超過したリクエストは数えず、空きが出るまでの ms を返す
+var slidingWindowScript = redis.NewScript(1, `
+local key = KEYS[1]
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local limit = tonumber(ARGV[3])
+redis.call('ZREMRANGEBYSCORE', key, 0, now - window)
+if redis.call('ZCARD', key) < limit then
+  redis.call('ZADD', key, now, ARGV[4])
+  redis.call('PEXPIRE', key, window)
+  return 0
+end
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return tonumber(oldest[2]) + window - now
+`)
+
+type RateLimit struct {
+	// ISUBATA_RATE_LIMIT_<NAME>=<回数>/<期間> で上書きできる (例: 30/10s)
+	Name   string
+	Limit  int
+	Window time.Duration
+	// 誰の回数として数えるか
+	Identity func(c echo.Context) string
+}
+
+var (
+	messageRateLimit = RateLimit{
+		Name: "message", Limit: 30, Window: 10 * time.Second, Identity: requestIdentity,
+	}
+	registerRateLimit = RateLimit{
+		Name: "register", Limit: 10, Window: time.Hour, Identity: remoteIPIdentity,
+	}
+	loginRateLimit = RateLimit{
+		Name: "login", Limit: 30, Window: time.Minute, Identity: remoteIPIdentity,
+	}
+	// 受信 webhook はフックごとに数える
+	webhookRateLimit = RateLimit{
+		Name: "webhook", Limit: 60, Window: time.Minute, Identity: webhookIdentity,
+	}
+
+	// 同じユーザ名に同じ IP アドレスから loginFailureLimit 回失敗すると loginLockout の間ログインできない
+	// ユーザ名だけで数えると、誰でも他人のアカウントをロックできてしまう
+	loginFailureLimit = 5
+	loginLockout      = 15 * time.Minute
+	// IP アドレスを変えながら試されたときのため、ユーザ名ごとにも loginLockout の間に
+	// loginAccountFailureLimit 回失敗したらロックする。続けてロックされるたびに期間を倍にする
+	loginAccountFailureLimit = 20
+	loginAccountMaxLockout   = 24 * time.Hour
+)
+
+func rateLimitDisabled() bool {
+	disabled := os.Getenv("ISUBATA_RATE_LIMIT_DISABLE")
+	return disabled == "true" || disabled == "1"
+}
+
+// requestIdentity はログインユーザ、Bearer トークン、IP アドレスの順に識別子を決める
+func requestIdentity(c echo.Context) string {
+	if userID := sessUserID(c); userID != 0 {
+		return "user:" + strconv.FormatInt(userID, 10)
+	}
+	if auth := c.Request().Header.Get(echo.HeaderAuthorization); strings.HasPrefix(auth, "Bearer ") {
+		return fmt.Sprintf("token:%x", sha1.Sum([]byte(strings.TrimPrefix(auth, "Bearer "))))
+	}
+	return remoteIPIdentity(c)
+}
+
+func remoteIPIdentity(c echo.Context) string {
+	return "ip:" + requestRemoteAddr(c.Request())
+}
+
+func (rl RateLimit) withEnv() RateLimit {
+	s := os.Getenv("ISUBATA_RATE_LIMIT_" + strings.ToUpper(rl.Name))
+	if s == "" {
+		return rl
+	}
+	parts := strings.SplitN(s, "/", 2)
+	limit, err := strconv.Atoi(parts[0])
+	if err != nil || len(parts) != 2 {
+		log.Fatalf("invalid ISUBATA_RATE_LIMIT_%s: %q", strings.ToUpper(rl.Name), s)
+	}
+	window, err := time.ParseDuration(parts[1])
+	if err != nil {
+		log.Fatalf("invalid ISUBATA_RATE_LIMIT_%s: %q", strings.ToUpper(rl.Name), s)
+	}
+	rl.Limit = limit
+	rl.Window = window
+	return rl
+}
+
+// allow は許可されれば 0 を、超過していれば次に許可されるまでの時間を返す
+func (rl RateLimit) allow(identity string) (time.Duration, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	now := time.Now()
+	key := rateLimitPrefix + rl.Name + "-" + identity
+	ms, err := redis.Int64(slidingWindowScript.Do(r.Conn,
+		key, now.UnixNano()/int64(time.Millisecond), int64(rl.Window/time.Millisecond), rl.Limit,
+		fmt.Sprintf("%d-%s", now.UnixNano(), randomString(8))))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+func tooManyRequests(c echo.Context, retryAfter time.Duration) error {
+	sec := int64(math.Ceil(retryAfter.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	c.Response().Header().Set("Retry-After", strconv.FormatInt(sec, 10))
+	return echo.NewHTTPError(http.StatusTooManyRequests)
+}
+
+// rateLimitMiddleware はルート単位で使う
+//
+//	e.POST("/message", postMessage, rateLimitMiddleware(messageRateLimit))
+func rateLimitMiddleware(rl RateLimit) echo.MiddlewareFunc {
+	rl = rl.withEnv()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if rateLimitDisabled() {
+				return next(c)
+			}
+			retryAfter, err := rl.allow(rl.Identity(c))
+			if err != nil {
+				// Redis が落ちていてもリクエストは止めない
+				log.Println(err, "IN rateLimitMiddleware")
+				return next(c)
+			}
+			if retryAfter > 0 {
+				return tooManyRequests(c, retryAfter)
+			}
+			return next(c)
+		}
+	}
+}
+
+func makeLoginFailureKey(name, ip string) string {
+	return loginFailurePrefix + ip + "-" + name
+}
+
+func makeAccountLoginFailureKey(name string) string {
+	return loginFailurePrefix + "account-" + name
+}
+
+func makeAccountLockKey(name string) string {
+	return loginFailurePrefix + "account-lock-" + name
+}
+
+// 何回続けてロックされたか。ロックが明けて loginAccountMaxLockout 経てば数え直す
+func makeAccountLockLevelKey(name string) string {
+	return loginFailurePrefix + "account-level-" + name
+}
+
+// accountLockout は level 回目のロックの期間を返す
+func accountLockout(level int) time.Duration {
+	d := loginLockout
+	for i := 1; i < level && d < loginAccountMaxLockout; i++ {
+		d *= 2
+	}
+	if d > loginAccountMaxLockout {
+		d = loginAccountMaxLockout
+	}
+	return d
+}
+
+// loginLockedOut はロック中なら解除までの時間を返す
+// IP アドレスとユーザ名の組と、ユーザ名だけのどちらかがロックされていればログインできない
+func loginLockedOut(name, ip string) time.Duration {
+	if rateLimitDisabled() {
+		return 0
+	}
+	r, err := NewRedisful()
+	if err != nil {
+		return 0
+	}
+	defer r.Close()
+
+	d := time.Duration(0)
+	if count, err := redis.Int(r.Conn.Do("GET", makeLoginFailureKey(name, ip))); err == nil && count >= loginFailureLimit {
+		d = pttl(r, makeLoginFailureKey(name, ip))
+	}
+	if a := pttl(r, makeAccountLockKey(name)); a > d {
+		d = a
+	}
+	return d
+}
+
+func pttl(r *Redisful, key string) time.Duration {
+	ttl, err := redis.Int64(r.Conn.Do("PTTL", key))
+	if err != nil || ttl <= 0 {
+		return 0
+	}
+	return time.Duration(ttl) * time.Millisecond
+}
+
+func recordLoginFailure(name, ip string) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	key := makeLoginFailureKey(name, ip)
+	count, err := redis.Int(r.Conn.Do("INCR", key))
+	if err != nil {
+		return err
+	}
+	// 最初の失敗から数え、上限に達した時点からロック期間を取り直す
+	if count == 1 || count == loginFailureLimit {
+		if _, err := r.Conn.Do("PEXPIRE", key, int64(loginLockout/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+
+	key = makeAccountLoginFailureKey(name)
+	count, err = redis.Int(r.Conn.Do("INCR", key))
+	if err != nil {
+		return err
+	}
+	if count == 1 {
+		if _, err := r.Conn.Do("PEXPIRE", key, int64(loginLockout/time.Millisecond)); err != nil {
+			return err
+		}
+	}
+	if count < loginAccountFailureLimit {
+		return nil
+	}
+	levelKey := makeAccountLockLevelKey(name)
+	level, err := redis.Int(r.Conn.Do("INCR", levelKey))
+	if err != nil {
+		return err
+	}
+	lockout := accountLockout(level)
+	if _, err := r.Conn.Do("PEXPIRE", levelKey, int64((lockout+loginAccountMaxLockout)/time.Millisecond)); err != nil {
+		return err
+	}
+	if _, err := r.Conn.Do("SET", makeAccountLockKey(name), level, "PX", int64(lockout/time.Millisecond)); err != nil {
+		return err
+	}
+	return r.DeleteDataInCache(key)
+}
+
+// clearLoginFailures はその IP アドレスからの失敗だけを消す
+// ユーザ名ごとの回数は、本人がログインしても攻撃が続いているかもしれないので期限まで残す
+func clearLoginFailures(name, ip string) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.DeleteDataInCache(makeLoginFailureKey(name, ip))
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func clearAccountLoginFailures(name string) {
+	r, err := NewRedisful()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	r.Conn.Do("DEL", makeAccountLoginFailureKey(name), makeAccountLockKey(name), makeAccountLockLevelKey(name))
+}
+
+func TestLoginLockoutIsPerClientIP(t *testing.T) {
+	requireRedis(t)
+	name := "lockout-" + randomString(8)
+	attacker, owner := "192.0.2.1", "198.51.100.7"
+	defer clearLoginFailures(name, attacker)
+	defer clearAccountLoginFailures(name)
+
+	for i := 0; i < loginFailureLimit-1; i++ {
+		if err := recordLoginFailure(name, attacker); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d := loginLockedOut(name, attacker); d != 0 {
+		t.Fatalf("locked out after %d failures: %v", loginFailureLimit-1, d)
+	}
+	if err := recordLoginFailure(name, attacker); err != nil {
+		t.Fatal(err)
+	}
+	if d := loginLockedOut(name, attacker); d <= 0 || d > loginLockout {
+		t.Fatalf("lockout = %v, want (0, %v]", d, loginLockout)
+	}
+	// 他の IP アドレスからは持ち主がログインできる
+	if d := loginLockedOut(name, owner); d != 0 {
+		t.Fatalf("owner is locked out: %v", d)
+	}
+
+	if err := clearLoginFailures(name, attacker); err != nil {
+		t.Fatal(err)
+	}
+	if d := loginLockedOut(name, attacker); d != 0 {
+		t.Fatalf("still locked out after clear: %v", d)
+	}
+}
+
+// IP アドレスを変えながら試しても、ユーザ名ごとの上限でロックされる
+func TestLoginLockoutPerAccount(t *testing.T) {
+	requireRedis(t)
+	name := "lockout-" + randomString(8)
+	defer clearAccountLoginFailures(name)
+
+	fail := func(round int) {
+		for i := 0; i < loginAccountFailureLimit; i++ {
+			ip := fmt.Sprintf("203.0.113.%d", round*loginAccountFailureLimit+i)
+			if d := loginLockedOut(name, ip); d != 0 {
+				t.Fatalf("round %d: locked out after %d failures: %v", round, i, d)
+			}
+			if err := recordLoginFailure(name, ip); err != nil {
+				t.Fatal(err)
+			}
+			defer clearLoginFailures(name, ip)
+		}
+	}
+
+	fail(0)
+	d := loginLockedOut(name, "198.51.100.7")
+	if d <= 0 || d > loginLockout {
+		t.Fatalf("lockout = %v, want (0, %v]", d, loginLockout)
+	}
+	// ログインに成功しても、その IP アドレスの分しか消えない
+	clearLoginFailures(name, "198.51.100.7")
+	if loginLockedOut(name, "198.51.100.7") == 0 {
+		t.Fatal("lockout was cleared")
+	}
+
+	// ロックが明けた後にまた上限に達すると、期間が倍になる
+	r, err := NewRedisful()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.DeleteDataInCache(makeAccountLockKey(name))
+	r.Close()
+	fail(1)
+	d = loginLockedOut(name, "198.51.100.7")
+	if d <= loginLockout || d > 2*loginLockout {
+		t.Fatalf("second lockout = %v, want (%v, %v]", d, loginLockout, 2*loginLockout)
+	}
+}
+
+func TestAccountLockout(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  loginLockout,
+		2:  2 * loginLockout,
+		3:  4 * loginLockout,
+		30: loginAccountMaxLockout,
+	}
+	for level, want := range cases {
+		if got := accountLockout(level); got != want {
+			t.Errorf("accountLockout(%d) = %v, want %v", level, got, want)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	requireRedis(t)
+	if rateLimitDisabled() {
+		t.Skip("ISUBATA_RATE_LIMIT_DISABLE is set")
+	}
+
+	e := echo.New()
+	rl := RateLimit{Name: "test-" + randomString(8), Limit: 2, Window: time.Minute, Identity: remoteIPIdentity}
+	e.GET("/", func(c echo.Context) error { return c.NoContent(http.StatusNoContent) }, rateLimitMiddleware(rl))
+
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < rl.Limit; i++ {
+		if rec := get("192.0.2.10"); rec.Code != http.StatusNoContent {
+			t.Fatalf("request %d: status %d", i, rec.Code)
+		}
+	}
+	rec := get("192.0.2.10")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over the limit: status %d", rec.Code)
+	}
+	sec, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || sec < 1 || sec > 60 {
+		t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+	// 他のクライアントは数えない
+	if rec := get("192.0.2.11"); rec.Code != http.StatusNoContent {
+		t.Errorf("other client: status %d", rec.Code)
+	}
+}
+
+// ロック中は正しいパスワードでも 429 と Retry-After を返す
+func TestPostLoginLockout(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+	if rateLimitDisabled() {
+		t.Skip("ISUBATA_RATE_LIMIT_DISABLE is set")
+	}
+
+	name := testName("locked")
+	userID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	if err := updatePassword(userID, "correct-password"); err != nil {
+		t.Fatal(err)
+	}
+	const ip = "192.0.2.20"
+	defer clearLoginFailures(name, ip)
+	defer clearAccountLoginFailures(name)
+
+	e := echo.New()
+	e.POST("/login", postLogin)
+	login := func(pw string) *httptest.ResponseRecorder {
+		form := url.Values{"name": {name}, "password": {pw}}
+		req := httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationForm)
+		req.RemoteAddr = ip + ":12345"
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	for i := 0; i < loginFailureLimit; i++ {
+		if rec := login("wrong-password"); rec.Code != http.StatusForbidden {
+			t.Fatalf("failure %d: status %d", i, rec.Code)
+		}
+	}
+	rec := login("correct-password")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("locked out: status %d", rec.Code)
+	}
+	sec, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if err != nil || sec < 1 || sec > int(loginLockout/time.Second) {
+		t.Errorf("Retry-After = %q", rec.Header().Get("Retry-After"))
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql/driver"
+
+	"github.com/labstack/echo"
+)
+
+type Role string
+
+// go-sql-driver/mysql は string を元にした型をそのまま渡せないので文字列にする
+func (r Role) Value() (driver.Value, error) {
+	return string(r), nil
+}
+
+const (
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+	// 閲覧のみ
+	RoleGuest Role = "guest"
+	// ログインできない bot ユーザ。権限は持たず、BotContext からだけ投稿する
+	RoleBot Role = "bot"
+)
+
+type Permission int
+
+const (
+	PermPostMessage Permission = iota
+	PermCreateChannel
+	// 自分が作ったチャンネルの編集・削除
+	PermManageOwnChannel
+	// 全てのチャンネルの編集・アーカイブ・削除
+	PermManageAnyChannel
+	// 他人のメッセージの編集・削除
+	PermModerateMessage
+	PermManageUsers
+)
+
+var rolePermissions = map[Role][]Permission{
+	RoleAdmin: {
+		PermPostMessage, PermCreateChannel, PermManageOwnChannel,
+		PermManageAnyChannel, PermModerateMessage, PermManageUsers,
+	},
+	RoleMember: {
+		PermPostMessage, PermCreateChannel, PermManageOwnChannel,
+	},
+	RoleGuest: {},
+}
+
+func validRole(r Role) bool {
+	_, ok := rolePermissions[r]
+	return ok
+}
+
+func (u *User) Can(p Permission) bool {
+	if u.BannedAt != nil {
+		return false
+	}
+	for _, granted := range rolePermissions[u.Role] {
+		if granted == p {
+			return true
+		}
+	}
+	return false
+}
+
+func (u *User) IsAdmin() bool {
+	return u.Can(PermManageUsers)
+}
+
+// requirePermission は権限がなければ 403 を返す
+func requirePermission(u *User, p Permission) error {
+	if !u.Can(p) {
+		return echo.ErrForbidden
+	}
+	return nil
+}
+
+// requireChannelPermission はアーカイブ済みのチャンネルへの書き込みも拒否する
+func requireChannelPermission(u *User, ch *ChannelInfo, p Permission) error {
+	if err := requirePermission(u, p); err != nil {
+		return err
+	}
+	if ch.ArchivedAt != nil && p == PermPostMessage {
+		return echo.ErrForbidden
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"isubata/fakes3"
+)
+
+func TestS3BlobStore(t *testing.T) {
+	s3 := fakes3.New("test-access", "test-secret")
+	s3.MaxKeys = 2
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	store, err := newS3BlobStore(srv.URL, "isubata", "us-east-1", "test-access", "test-secret", "icons/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Put("a.png", []byte("image-a")); err != nil {
+		t.Fatal(err)
+	}
+	blob, err := store.Get("a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(blob.Data) != "image-a" || blob.Size != 7 || blob.ModTime.IsZero() {
+		t.Errorf("Get = %+v", blob)
+	}
+	if _, err := store.Get("missing.png"); err != ErrBlobNotFound {
+		t.Errorf("Get missing: err = %v", err)
+	}
+
+	if err := store.Delete("a.png"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("a.png"); err != ErrBlobNotFound {
+		t.Errorf("Get after Delete: err = %v", err)
+	}
+	if err := store.Delete("a.png"); err != nil {
+		t.Errorf("Delete twice: err = %v", err)
+	}
+
+	// 1ページ2件なので continuation-token をたどって3ページ分読む
+	want := []string{}
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("%d.png", i)
+		if err := store.Put(name, []byte(name)); err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, name)
+	}
+	// prefix の外にあるものは返さない
+	other, _ := newS3BlobStore(srv.URL, "isubata", "us-east-1", "test-access", "test-secret", "files/")
+	if err := other.Put("x.png", []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+
+	blobs, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, b := range blobs {
+		got = append(got, b.Name)
+	}
+	sort.Strings(got)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("List = %v, want %v", got, want)
+	}
+}
+
+func TestS3BlobStoreRejectsBadSignature(t *testing.T) {
+	s3 := fakes3.New("test-access", "test-secret")
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	store, err := newS3BlobStore(srv.URL, "isubata", "us-east-1", "test-access", "wrong-secret", "icons/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put("a.png", []byte("image-a")); err == nil {
+		t.Error("Put succeeded with a wrong secret key")
+	}
+	if keys := s3.Keys("isubata"); len(keys) != 0 {
+		t.Errorf("stored %v", keys)
+	}
+	if _, err := store.List(); err == nil {
+		t.Error("List succeeded with a wrong secret key")
+	}
+}
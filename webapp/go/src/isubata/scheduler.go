@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+const (
+	ScheduledKindMessage  = "message"
+	ScheduledKindReminder = "reminder"
+
+	ScheduledStatusPending = "pending"
+	ScheduledStatusSent    = "sent"
+	ScheduledStatusFailed  = "failed"
+
+	schedulerLockKey   = "SCHEDULER-LEADER"
+	schedulerLockTTL   = 10
+	schedulerInterval  = time.Second
+	schedulerBatchSize = 100
+
+	maxScheduleAhead     = 365 * 24 * time.Hour
+	maxPendingScheduled  = 100
+	maxScheduledContent  = 2000
+	scheduleDeliverAtFmt = "2006-01-02T15:04"
+
+	// メッセージへのリマインダーで引用する長さ
+	maxReminderQuote = 200
+)
+
+type ScheduledMessage struct {
+	ID        int64  `db:"id"`
+	Kind      string `db:"kind"`
+	UserID    int64  `db:"user_id"`
+	ChannelID int64  `db:"channel_id"`
+	// リマインダーの対象。予約投稿と /remind では 0
+	MessageID   int64      `db:"message_id"`
+	Content     string     `db:"content"`
+	DeliverAt   time.Time  `db:"deliver_at"`
+	Status      string     `db:"status"`
+	DeliveredAt *time.Time `db:"delivered_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+}
+
+// 自分がリーダーのときだけ延長する
+var extendLeaderScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('EXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// schedulerInstanceID は複数台のどれがリーダーかを見分ける
+var schedulerInstanceID = func() string {
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), secureRandomString(8))
+}()
+
+// acquireSchedulerLeader は SETNX でロックを取るか、取っているロックを延長する
+func acquireSchedulerLeader() (bool, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return false, err
+	}
+	defer r.Close()
+
+	reply, err := redis.String(r.Conn.Do("SET", schedulerLockKey, schedulerInstanceID, "NX", "EX", schedulerLockTTL))
+	if err == nil && reply == "OK" {
+		return true, nil
+	}
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+	n, err := redis.Int(extendLeaderScript.Do(r.Conn, schedulerLockKey, schedulerInstanceID, schedulerLockTTL))
+	return n == 1, err
+}
+
+// runScheduler はプロセスごとに1つ起動し、リーダーになった1台だけが配信する
+func runScheduler() {
+	ticker := time.NewTicker(schedulerInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		leader, err := acquireSchedulerLeader()
+		if err != nil {
+			log.Println(err, "IN runScheduler")
+			continue
+		}
+		if !leader {
+			continue
+		}
+		if err := deliverDueScheduledMessages(time.Now()); err != nil {
+			log.Println(err, "IN runScheduler")
+		}
+	}
+}
+
+func deliverDueScheduledMessages(now time.Time) error {
+	due := []ScheduledMessage{}
+	err := db.Select(&due,
+		"SELECT * FROM scheduled_message WHERE status = ? AND deliver_at <= ? ORDER BY deliver_at, id LIMIT ?",
+		ScheduledStatusPending, now, schedulerBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, s := range due {
+		// 二重に配信しないよう先に pending から外す
+		res, err := db.Exec("UPDATE scheduled_message SET status = ?, delivered_at = ? WHERE id = ? AND status = ?",
+			ScheduledStatusSent, now, s.ID, ScheduledStatusPending)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n != 1 {
+			continue
+		}
+		if err := deliverScheduledMessage(s); err != nil {
+			log.Printf("failed to deliver scheduled_message %d: %v", s.ID, err)
+			db.Exec("UPDATE scheduled_message SET status = ? WHERE id = ?", ScheduledStatusFailed, s.ID)
+		}
+	}
+	return nil
+}
+
+// deliverScheduledMessage は配信時点の権限で投稿する
+func deliverScheduledMessage(s ScheduledMessage) error {
+	user, err := getUser(s.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %d not found", s.UserID)
+	}
+	ch, err := getChannelInfo(s.ChannelID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return fmt.Errorf("channel %d not found", s.ChannelID)
+	}
+
+	switch s.Kind {
+	case ScheduledKindMessage:
+		if err := requireChannelPermission(user, ch, PermPostMessage); err != nil {
+			return err
+		}
+		_, err = addMessage(s.ChannelID, s.UserID, s.Content)
+		return err
+	case ScheduledKindReminder:
+		// リマインダーは isubot がチャンネルでメンションして知らせる
+		if ch.ArchivedAt != nil {
+			return fmt.Errorf("channel %d is archived", s.ChannelID)
+		}
+		if s.MessageID == 0 {
+			return replyAsBot(isubot, ch.ID, fmt.Sprintf("@%s リマインダー: %s", user.Name, s.Content))
+		}
+		// メッセージへのリマインダーは元のメッセージを引用する
+		m, err := getMessageByID(s.MessageID)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			return fmt.Errorf("message %d not found", s.MessageID)
+		}
+		author, err := getUser(m.UserID)
+		if err != nil {
+			return err
+		}
+		return replyAsBot(isubot, m.ChannelID, messageReminderContent(user, author, m))
+	}
+	return fmt.Errorf("unknown kind %q", s.Kind)
+}
+
+// messageReminderContent はメッセージへのリマインダーの本文
+// 作者や引用中の @name にはメンションしない(全角にして未読のメンションに数えない)
+func messageReminderContent(user, author *User, m *Message) string {
+	from := deletedUserDisplayName
+	if author != nil {
+		from = author.DisplayName
+	}
+	content := strings.Replace(m.Content, "@", "＠", -1)
+	if utf8.RuneCountInString(content) > maxReminderQuote {
+		content = string([]rune(content)[:maxReminderQuote]) + "…"
+	}
+	lines := strings.Split(content, "\n")
+	for i, line := range lines {
+		lines[i] = "> " + line
+	}
+	return fmt.Sprintf("@%s リマインダー: %s さんのメッセージ\n%s", user.Name, from, strings.Join(lines, "\n"))
+}
+
+// parseDeliverAt は after (例: 30m, 1h) か deliver_at (datetime-local の形式) を読む
+func parseDeliverAt(c echo.Context, now time.Time) (time.Time, error) {
+	var t time.Time
+	if s := c.FormValue("after"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return t, ErrBadReqeust
+		}
+		t = now.Add(d)
+	} else {
+		var err error
+		t, err = time.ParseInLocation(scheduleDeliverAtFmt, c.FormValue("deliver_at"), time.Local)
+		if err != nil {
+			return t, ErrBadReqeust
+		}
+	}
+	if !t.After(now) || t.Sub(now) > maxScheduleAhead {
+		return t, ErrBadReqeust
+	}
+	return t, nil
+}
+
+func countPendingScheduled(userID int64) (int64, error) {
+	var cnt int64
+	err := db.Get(&cnt, "SELECT COUNT(*) FROM scheduled_message WHERE user_id = ? AND status = ?",
+		userID, ScheduledStatusPending)
+	return cnt, err
+}
+
+func insertScheduledMessage(s ScheduledMessage) error {
+	cnt, err := countPendingScheduled(s.UserID)
+	if err != nil {
+		return err
+	}
+	if cnt >= maxPendingScheduled {
+		return ErrBadReqeust
+	}
+	_, err = db.Exec("INSERT INTO scheduled_message"+
+		" (kind, user_id, channel_id, message_id, content, deliver_at, status, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, ?, ?, NOW())",
+		s.Kind, s.UserID, s.ChannelID, s.MessageID, s.Content, s.DeliverAt, ScheduledStatusPending)
+	return err
+}
+
+//request handlers
+
+func getScheduled(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	pending := []ScheduledMessage{}
+	err = db.Select(&pending, "SELECT * FROM scheduled_message WHERE user_id = ? AND status = ? ORDER BY deliver_at, id",
+		self.ID, ScheduledStatusPending)
+	if err != nil {
+		return err
+	}
+	failed := []ScheduledMessage{}
+	err = db.Select(&failed, "SELECT * FROM scheduled_message WHERE user_id = ? AND status = ? ORDER BY deliver_at DESC LIMIT 20",
+		self.ID, ScheduledStatusFailed)
+	if err != nil {
+		return err
+	}
+	channels, err := queryUserChannels(self.ID)
+	if err != nil {
+		return err
+	}
+	names := map[int64]string{}
+	for _, ch := range channels {
+		names[ch.ID] = ch.Name
+	}
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "scheduled", map[string]interface{}{
+		"ChannelID":    0,
+		"Sidebar":      sidebar,
+		"User":         self,
+		"Pending":      pending,
+		"Failed":       failed,
+		"UserChannels": channels,
+		"ChannelNames": names,
+		"MinDeliverAt": time.Now().Add(time.Minute).Format(scheduleDeliverAtFmt),
+	})
+}
+
+func postScheduledMessage(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	content := strings.TrimSpace(c.FormValue("content"))
+	if content == "" || utf8.RuneCountInString(content) > maxScheduledContent {
+		return ErrBadReqeust
+	}
+	chID, err := strconv.ParseInt(c.FormValue("channel_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	ch, err := getChannelInfo(chID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return echo.ErrNotFound
+	}
+	if err := requireChannelPermission(self, ch, PermPostMessage); err != nil {
+		return err
+	}
+	deliverAt, err := parseDeliverAt(c, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = insertScheduledMessage(ScheduledMessage{
+		Kind:      ScheduledKindMessage,
+		UserID:    self.ID,
+		ChannelID: ch.ID,
+		Content:   content,
+		DeliverAt: deliverAt,
+	})
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/scheduled")
+}
+
+func postReminder(c echo.Context) error {
+	userID := sessUserID(c)
+	if userID == 0 {
+		return c.NoContent(http.StatusForbidden)
+	}
+
+	mID, err := strconv.ParseInt(c.FormValue("message_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	m, err := getMessageByID(mID)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return echo.ErrNotFound
+	}
+	deliverAt, err := parseDeliverAt(c, time.Now())
+	if err != nil {
+		return err
+	}
+
+	err = insertScheduledMessage(ScheduledMessage{
+		Kind:      ScheduledKindReminder,
+		UserID:    userID,
+		ChannelID: m.ChannelID,
+		MessageID: m.ID,
+		DeliverAt: deliverAt,
+	})
+	if err != nil {
+		return err
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func postCancelScheduled(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	id, err := strconv.ParseInt(c.Param("scheduled_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	_, err = db.Exec("DELETE FROM scheduled_message WHERE id = ? AND user_id = ? AND status <> ?",
+		id, self.ID, ScheduledStatusSent)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/scheduled")
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageReminderContent(t *testing.T) {
+	user := &User{Name: "alice"}
+	author := &User{Name: "bob", DisplayName: "Bob"}
+	m := &Message{Content: "hi @carol\nsee you"}
+
+	got := messageReminderContent(user, author, m)
+	want := "@alice リマインダー: Bob さんのメッセージ\n> hi ＠carol\n> see you"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if strings.Contains(got, "@bob") || strings.Contains(got, "@carol") {
+		t.Errorf("mentions someone other than the owner: %q", got)
+	}
+
+	m.Content = strings.Repeat("あ", maxReminderQuote+10)
+	got = messageReminderContent(user, nil, m)
+	if !strings.Contains(got, deletedUserDisplayName) || !strings.HasSuffix(got, strings.Repeat("あ", maxReminderQuote)+"…") {
+		t.Errorf("got %q", got)
+	}
+}
+
+// メッセージへのリマインダーは isubot のメンションで届き、既読位置は動かさない
+func TestDeliverMessageReminder(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := fmt.Sprintf("remind%d", time.Now().UnixNano()%1000000000)
+	res, err := db.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
+		" VALUES (?, '', '', ?, 'default.png', NOW())", name, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userID, _ := res.LastInsertId()
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	res, err = db.Exec("INSERT INTO channel (name, description, updated_at, created_at) VALUES (?, '', NOW(), NOW())", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	chID, _ := res.LastInsertId()
+	defer db.Exec("DELETE FROM channel WHERE id = ?", chID)
+	defer db.Exec("DELETE FROM message WHERE channel_id = ?", chID)
+
+	mID, err := addMessage(chID, userID, "あとで読む")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setHaveRead(HaveRead{UserID: userID, ChannelID: chID, MessageID: mID}); err != nil {
+		t.Fatal(err)
+	}
+
+	err = deliverScheduledMessage(ScheduledMessage{
+		Kind:      ScheduledKindReminder,
+		UserID:    userID,
+		ChannelID: chID,
+		MessageID: mID,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var last Message
+	if err := db.Get(&last, "SELECT * FROM message WHERE channel_id = ? ORDER BY id DESC LIMIT 1", chID); err != nil {
+		t.Fatal(err)
+	}
+	if last.ID == mID || last.Kind != MessageKindBot || !strings.HasPrefix(last.Content, "@"+name+" ") {
+		t.Errorf("reminder = %+v", last)
+	}
+	read, err := getHaveRead(userID, chID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if read != mID {
+		t.Errorf("haveread = %d, want %d", read, mID)
+	}
+	var saved int
+	db.Get(&saved, "SELECT COUNT(*) FROM saved_message WHERE user_id = ?", userID)
+	if saved != 0 {
+		t.Errorf("saved_message = %d", saved)
+	}
+}
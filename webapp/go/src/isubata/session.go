@@ -3,7 +3,6 @@ package main
 import (
 	"net/http"
 
-	"github.com/gorilla/sessions"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo-contrib/session"
 )
@@ -19,13 +18,22 @@ func sessUserID(c echo.Context) int64 {
 
 func sessSetUserID(c echo.Context, id int64) {
 	sess, _ := session.Get("session", c)
-	sess.Options = &sessions.Options{
-		HttpOnly: true,
-		MaxAge:   360000,
+	// session fixation 対策でログインのたびに ID を振り直す
+	if sess.ID != "" {
+		deleteSessionRecord(sess.ID)
+		sess.ID = ""
 	}
 	sess.Values["user_id"] = id
 	sess.Save(c.Request(), c.Response())
 }
+
+func sessClearUserID(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "user_id")
+	sess.Options.MaxAge = -1
+	sess.Save(c.Request(), c.Response())
+}
+
 func ensureLogin(c echo.Context) (*User, error) {
 	var user *User
 	var err error
@@ -39,10 +47,8 @@ func ensureLogin(c echo.Context) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
-	if user == nil {
-		sess, _ := session.Get("session", c)
-		delete(sess.Values, "user_id")
-		sess.Save(c.Request(), c.Response())
+	if user == nil || user.BannedAt != nil {
+		sessClearUserID(c)
 		goto redirect
 	}
 	return user, nil
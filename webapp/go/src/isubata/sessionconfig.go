@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	defaultSessionMaxAge = 360000
+)
+
+type SessionConfig struct {
+	// 先頭の鍵で署名し、残りは検証のみに使う(ローテーション中の旧鍵)
+	KeyPairs [][]byte
+	MaxAge   int
+	Secure   bool
+	SameSite http.SameSite
+}
+
+// loadSessionConfig は環境変数からセッションの鍵と cookie の属性を読み込む
+//
+//	ISUBATA_SESSION_KEYS      "hashKey[:blockKey]" をカンマ区切りで並べたもの(base64)
+//	ISUBATA_SESSION_KEY_FILE  同じ形式を1行1組で書いたファイル。# 以降はコメント
+//	ISUBATA_SESSION_MAX_AGE   秒数
+//	ISUBATA_SESSION_SECURE    true なら Secure 属性を付ける
+//	ISUBATA_SESSION_SAMESITE  lax, strict, none のいずれか
+func loadSessionConfig() (*SessionConfig, error) {
+	cfg := &SessionConfig{
+		MaxAge:   defaultSessionMaxAge,
+		SameSite: http.SameSiteLaxMode,
+	}
+
+	var entries []string
+	if s := os.Getenv("ISUBATA_SESSION_KEYS"); s != "" {
+		entries = append(entries, strings.Split(s, ",")...)
+	}
+	if path := os.Getenv("ISUBATA_SESSION_KEY_FILE"); path != "" {
+		lines, err := readSessionKeyFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, lines...)
+	}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		hashKey, blockKey, err := parseSessionKeyPair(entry)
+		if err != nil {
+			return nil, err
+		}
+		cfg.KeyPairs = append(cfg.KeyPairs, hashKey, blockKey)
+	}
+	if len(cfg.KeyPairs) == 0 {
+		// 再起動のたびに全員ログアウトされ、複数台構成でも共有できない
+		log.Println("ISUBATA_SESSION_KEYS is not set. using a random session key")
+		cfg.KeyPairs = [][]byte{securecookie.GenerateRandomKey(64), nil}
+	}
+
+	if s := os.Getenv("ISUBATA_SESSION_MAX_AGE"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid ISUBATA_SESSION_MAX_AGE: %q", s)
+		}
+		cfg.MaxAge = n
+	}
+	if s := os.Getenv("ISUBATA_SESSION_SECURE"); s != "" {
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISUBATA_SESSION_SECURE: %q", s)
+		}
+		cfg.Secure = b
+	}
+	switch s := strings.ToLower(os.Getenv("ISUBATA_SESSION_SAMESITE")); s {
+	case "", "lax":
+		cfg.SameSite = http.SameSiteLaxMode
+	case "strict":
+		cfg.SameSite = http.SameSiteStrictMode
+	case "none":
+		// SameSite=None は Secure でないとブラウザに捨てられる
+		if !cfg.Secure {
+			return nil, fmt.Errorf("ISUBATA_SESSION_SAMESITE=none requires ISUBATA_SESSION_SECURE=true")
+		}
+		cfg.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("invalid ISUBATA_SESSION_SAMESITE: %q", s)
+	}
+	return cfg, nil
+}
+
+func readSessionKeyFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if pos := strings.IndexByte(line, '#'); pos >= 0 {
+			line = line[:pos]
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+func parseSessionKeyPair(entry string) (hashKey, blockKey []byte, err error) {
+	parts := strings.SplitN(entry, ":", 2)
+	hashKey, err = base64.StdEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid session hash key: %v", err)
+	}
+	if len(hashKey) < 32 {
+		return nil, nil, fmt.Errorf("session hash key must be at least 32 bytes")
+	}
+	if len(parts) == 2 {
+		blockKey, err = base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid session block key: %v", err)
+		}
+		switch len(blockKey) {
+		case 16, 24, 32:
+		default:
+			return nil, nil, fmt.Errorf("session block key must be 16, 24 or 32 bytes")
+		}
+	}
+	return hashKey, blockKey, nil
+}
+
+func newSessionStore(cfg *SessionConfig) *RedisStore {
+	store := NewRedisStore(cfg.KeyPairs...)
+	store.Options.HttpOnly = true
+	store.Options.Secure = cfg.Secure
+	store.SameSite = cfg.SameSite
+	store.MaxAge(cfg.MaxAge)
+	return store
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+const (
+	sessionPrefix      = "SESSION-"
+	userSessionsPrefix = "USER-SESSIONS-"
+
+	// last_seen_at の更新はこの間隔より短ければ省略する
+	sessionTouchInterval = 60
+)
+
+func makeSessionKey(id string) string {
+	return sessionPrefix + id
+}
+
+func makeUserSessionsKey(userID int64) string {
+	return userSessionsPrefix + strconv.FormatInt(userID, 10)
+}
+
+// Redis に保存するセッションの中身
+// cookie にはランダムな ID を署名したものだけを載せる
+type SessionRecord struct {
+	ID         string `json:"id"`
+	UserID     int64  `json:"user_id"`
+	Values     []byte `json:"values"`
+	UserAgent  string `json:"user_agent"`
+	RemoteAddr string `json:"remote_addr"`
+	CreatedAt  int64  `json:"created_at"`
+	LastSeenAt int64  `json:"last_seen_at"`
+}
+
+func (s SessionRecord) CreatedTime() time.Time {
+	return time.Unix(s.CreatedAt, 0)
+}
+
+func (s SessionRecord) LastSeenTime() time.Time {
+	return time.Unix(s.LastSeenAt, 0)
+}
+
+// RedisStore は gorilla/sessions の Store 実装
+// 複数のアプリサーバから同じセッションを参照できる
+type RedisStore struct {
+	Codecs   []securecookie.Codec
+	Options  *sessions.Options
+	SameSite http.SameSite
+}
+
+func NewRedisStore(keyPairs ...[]byte) *RedisStore {
+	rs := &RedisStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+	rs.MaxAge(rs.Options.MaxAge)
+	return rs
+}
+
+func (s *RedisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *RedisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	sess := sessions.NewSession(s, name)
+	opts := *s.Options
+	sess.Options = &opts
+	sess.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return sess, nil
+	}
+	if err = securecookie.DecodeMulti(name, c.Value, &sess.ID, s.Codecs...); err != nil {
+		return sess, err
+	}
+	rec, err := loadSessionRecord(sess.ID)
+	if err == redis.ErrNil {
+		// 失効済み。新しい ID で作り直す
+		sess.ID = ""
+		return sess, nil
+	}
+	if err != nil {
+		return sess, err
+	}
+	if err = (securecookie.GobEncoder{}).Deserialize(rec.Values, &sess.Values); err != nil {
+		return sess, err
+	}
+	sess.IsNew = false
+
+	if now := time.Now().Unix(); now-rec.LastSeenAt > sessionTouchInterval {
+		rec.LastSeenAt = now
+		rec.RemoteAddr = requestRemoteAddr(r)
+		saveSessionRecord(*rec, sess.Options.MaxAge)
+	}
+	return sess, nil
+}
+
+// Options.MaxAge が 0 以下なら Redis からも削除する
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, sess *sessions.Session) error {
+	if sess.Options.MaxAge <= 0 {
+		if sess.ID != "" {
+			if err := deleteSessionRecord(sess.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, s.newCookie(sess.Name(), "", sess.Options))
+		return nil
+	}
+
+	now := time.Now().Unix()
+	rec := SessionRecord{ID: sess.ID, CreatedAt: now}
+	if sess.ID == "" {
+		rec.ID = strings.TrimRight(
+			base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	} else if old, err := loadSessionRecord(sess.ID); err == nil {
+		rec.CreatedAt = old.CreatedAt
+		if old.UserID != 0 {
+			removeUserSessionIndex(old.UserID, sess.ID)
+		}
+	}
+
+	values, err := (securecookie.GobEncoder{}).Serialize(sess.Values)
+	if err != nil {
+		return err
+	}
+	rec.Values = values
+	rec.UserID, _ = sess.Values["user_id"].(int64)
+	rec.UserAgent = r.UserAgent()
+	rec.RemoteAddr = requestRemoteAddr(r)
+	rec.LastSeenAt = now
+	if err := saveSessionRecord(rec, sess.Options.MaxAge); err != nil {
+		return err
+	}
+	sess.ID = rec.ID
+
+	encoded, err := securecookie.EncodeMulti(sess.Name(), sess.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, s.newCookie(sess.Name(), encoded, sess.Options))
+	return nil
+}
+
+// sessions.Options には SameSite がないのでここで付ける
+func (s *RedisStore) newCookie(name, value string, options *sessions.Options) *http.Cookie {
+	cookie := sessions.NewCookie(name, value, options)
+	cookie.SameSite = s.SameSite
+	return cookie
+}
+
+func (s *RedisStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// X-Real-IP と X-Forwarded-For は直接つないできたのがこのプロキシのときだけ使う
+// 既定は同じホストの nginx
+var trustedProxies = parseTrustedProxies(envOrDefault("ISUBATA_TRUSTED_PROXIES", "127.0.0.1/32,::1/128"))
+
+// parseTrustedProxies はカンマ区切りの IP アドレスか CIDR を読む
+func parseTrustedProxies(s string) []*net.IPNet {
+	nets := []*net.IPNet{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("invalid ISUBATA_TRUSTED_PROXIES: %q", s)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestRemoteAddr はクライアントの IP アドレスを返す
+// ヘッダはクライアントが自由に付けられるので、信頼するプロキシから来たときだけ読む
+func requestRemoteAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	// X-Forwarded-For は右から、信頼するプロキシでない最初のアドレスを使う
+	hops := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		if !isTrustedProxy(ip) {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+func loadSessionRecord(id string) (*SessionRecord, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := r.GetDataFromCache(makeSessionKey(id))
+	if err != nil {
+		return nil, err
+	}
+	var rec SessionRecord
+	if err = json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func saveSessionRecord(rec SessionRecord, maxAge int) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = r.SetDataToCacheWithExpire(makeSessionKey(rec.ID), rec, maxAge); err != nil {
+		return err
+	}
+	if rec.UserID != 0 {
+		return r.PushSetToCache(makeUserSessionsKey(rec.UserID), rec.ID)
+	}
+	return nil
+}
+
+func removeUserSessionIndex(userID int64, id string) error {
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return r.RemoveSetFromCache(makeUserSessionsKey(userID), id)
+}
+
+func deleteSessionRecord(id string) error {
+	rec, err := loadSessionRecord(id)
+	if err == redis.ErrNil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	r, err := NewRedisful()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err = r.DeleteDataInCache(makeSessionKey(id)); err != nil {
+		return err
+	}
+	if rec.UserID != 0 {
+		return r.RemoveSetFromCache(makeUserSessionsKey(rec.UserID), id)
+	}
+	return nil
+}
+
+// listUserSessions は有効なセッションを最後に使われた順で返す
+// 期限切れで消えたものはインデックスからも取り除く
+func listUserSessions(userID int64) ([]SessionRecord, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := r.GetSetFromCache(makeUserSessionsKey(userID))
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	if err = json.Unmarshal(data, &ids); err != nil {
+		return nil, err
+	}
+
+	records := make([]SessionRecord, 0, len(ids))
+	for _, id := range ids {
+		rec, err := loadSessionRecord(id)
+		if err == redis.ErrNil || (err == nil && rec.UserID != userID) {
+			r.RemoveSetFromCache(makeUserSessionsKey(userID), id)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, *rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].LastSeenAt > records[j].LastSeenAt
+	})
+	return records, nil
+}
+
+// revokeUserSessions はユーザの全てのセッションを削除する
+func revokeUserSessions(userID int64) error {
+	records, err := listUserSessions(userID)
+	if err != nil {
+		return err
+	}
+	for _, rec := range records {
+		if err := deleteSessionRecord(rec.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//request handlers
+
+func getSessions(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	records, err := listUserSessions(self.ID)
+	if err != nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	sess, _ := session.Get("session", c)
+	return c.Render(http.StatusOK, "sessions", map[string]interface{}{
+		"ChannelID": 0,
+		"Sidebar":   sidebar,
+		"User":      self,
+		"Sessions":  records,
+		"CurrentID": sess.ID,
+	})
+}
+
+func postRevokeSession(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	id := c.Param("session_id")
+	rec, err := loadSessionRecord(id)
+	if err == redis.ErrNil {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if rec.UserID != self.ID {
+		return echo.ErrNotFound
+	}
+	if err := deleteSessionRecord(id); err != nil {
+		return err
+	}
+
+	if sess, _ := session.Get("session", c); sess.ID == id {
+		sessClearUserID(c)
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Redirect(http.StatusSeeOther, "/sessions")
+}
+
+func postRevokeAllSessions(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	if err := revokeUserSessions(self.ID); err != nil {
+		return err
+	}
+	sessClearUserID(c)
+	return c.Redirect(http.StatusSeeOther, "/login")
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+func TestParseTrustedProxies(t *testing.T) {
+	nets := parseTrustedProxies("10.0.0.1, 192.168.0.0/16,::1")
+	if len(nets) != 3 {
+		t.Fatalf("got %d networks", len(nets))
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"10.0.0.2":    false,
+		"192.168.3.4": true,
+		"::1":         true,
+		"127.0.0.1":   false,
+	} {
+		got := false
+		for _, n := range nets {
+			if n.Contains(net.ParseIP(ip)) {
+				got = true
+			}
+		}
+		if got != want {
+			t.Errorf("%s: got %v, want %v", ip, got, want)
+		}
+	}
+}
+
+func TestRequestRemoteAddr(t *testing.T) {
+	saved := trustedProxies
+	defer func() { trustedProxies = saved }()
+	trustedProxies = parseTrustedProxies("127.0.0.1,10.0.0.0/8")
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		realIP     string
+		forwarded  string
+		want       string
+	}{
+		{"direct", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		// プロキシを通していないクライアントのヘッダは無視する
+		{"spoofed headers", "203.0.113.5:1234", "198.51.100.1", "198.51.100.2", "203.0.113.5"},
+		{"nginx", "127.0.0.1:5555", "198.51.100.1", "", "198.51.100.1"},
+		{"nginx with forwarded", "127.0.0.1:5555", "", "198.51.100.2", "198.51.100.2"},
+		// 左側はクライアントが付けられるので、右から信頼するプロキシを飛ばす
+		{"forwarded chain", "127.0.0.1:5555", "", "1.2.3.4, 198.51.100.2, 10.1.2.3", "198.51.100.2"},
+		{"broken real ip", "127.0.0.1:5555", "nope", "", "127.0.0.1"},
+		{"only proxies", "127.0.0.1:5555", "", "10.1.2.3", "127.0.0.1"},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tc.remoteAddr
+		if tc.realIP != "" {
+			r.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if tc.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", tc.forwarded)
+		}
+		if got := requestRemoteAddr(r); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+// newSessionTestApp は GET /test/whoami でセッションのユーザ ID を返す
+func newSessionTestApp(t *testing.T) *httptest.Server {
+	e, app := newTestApp(t)
+	e.GET("/test/whoami", func(c echo.Context) error {
+		return c.String(http.StatusOK, strconv.FormatInt(sessUserID(c), 10))
+	})
+	e.POST("/sessions/revoke_all", postRevokeAllSessions)
+	e.POST("/sessions/:session_id/revoke", postRevokeSession)
+	return app
+}
+
+func whoami(t *testing.T, app *httptest.Server, client *http.Client) int64 {
+	t.Helper()
+	res, err := client.Get(app.URL + "/test/whoami")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	id, _ := strconv.ParseInt(string(body), 10, 64)
+	return id
+}
+
+func userSessionIDs(t *testing.T, userID int64) map[string]bool {
+	t.Helper()
+	records, err := listUserSessions(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids := map[string]bool{}
+	for _, rec := range records {
+		ids[rec.ID] = true
+	}
+	return ids
+}
+
+// newIDs は after にあって before にない ID を返す
+func newIDs(before, after map[string]bool) []string {
+	ids := []string{}
+	for id := range after {
+		if !before[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func TestRedisStoreSessions(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("sess")
+	userID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	defer revokeUserSessions(userID)
+
+	app := newSessionTestApp(t)
+	defer app.Close()
+
+	// 作成と読み込み。Redis には MaxAge の期限付きで置く
+	laptop := newTestClient(t, app, userID)
+	if got := whoami(t, app, laptop); got != userID {
+		t.Fatalf("whoami = %d, want %d", got, userID)
+	}
+	ids := userSessionIDs(t, userID)
+	if len(ids) != 1 {
+		t.Fatalf("sessions = %v", ids)
+	}
+	laptopID := newIDs(nil, ids)[0]
+	r, err := NewRedisful()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	ttl, err := redis.Int64(r.Conn.Do("TTL", makeSessionKey(laptopID)))
+	if err != nil || ttl <= 0 || ttl > 86400*30 {
+		t.Errorf("TTL = %d, err = %v", ttl, err)
+	}
+
+	// ユーザごとの一覧
+	phone := newTestClient(t, app, userID)
+	after := userSessionIDs(t, userID)
+	if len(after) != 2 || !after[laptopID] {
+		t.Fatalf("sessions = %v", after)
+	}
+	phoneID := newIDs(ids, after)[0]
+
+	// ログインし直すと ID が変わり、前の ID は使えない
+	res, err := laptop.Get(fmt.Sprintf("%s/test/login/%d", app.URL, userID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	ids = userSessionIDs(t, userID)
+	if len(ids) != 2 || ids[laptopID] || !ids[phoneID] {
+		t.Fatalf("after re-login: sessions = %v", ids)
+	}
+	if _, err := loadSessionRecord(laptopID); err != redis.ErrNil {
+		t.Errorf("old session still loads: err = %v", err)
+	}
+	laptopID = newIDs(map[string]bool{phoneID: true}, ids)[0]
+	if got := whoami(t, app, laptop); got != userID {
+		t.Fatalf("after re-login: whoami = %d", got)
+	}
+
+	// 期限切れで消えたセッションはログインしていない扱いになり、一覧からも消える
+	tablet := newTestClient(t, app, userID)
+	tabletID := newIDs(ids, userSessionIDs(t, userID))[0]
+	if err := r.DeleteDataInCache(makeSessionKey(tabletID)); err != nil {
+		t.Fatal(err)
+	}
+	if got := whoami(t, app, tablet); got != 0 {
+		t.Errorf("expired session: whoami = %d", got)
+	}
+	if ids := userSessionIDs(t, userID); ids[tabletID] || len(ids) != 2 {
+		t.Errorf("expired session is listed: %v", ids)
+	}
+
+	// 1つだけ失効させる
+	res, err = laptop.Post(app.URL+"/sessions/"+phoneID+"/revoke", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/sessions" {
+		t.Fatalf("revoke: status %d, location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if got := whoami(t, app, phone); got != 0 {
+		t.Errorf("revoked session: whoami = %d", got)
+	}
+	if got := whoami(t, app, laptop); got != userID {
+		t.Errorf("other session was revoked: whoami = %d", got)
+	}
+
+	// 他人のセッションは失効させられない
+	otherID := insertTestUser(t, name+"x", RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", otherID)
+	defer revokeUserSessions(otherID)
+	other := newTestClient(t, app, otherID)
+	res, err = other.Post(app.URL+"/sessions/"+laptopID+"/revoke", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("revoke someone else's session: status %d", res.StatusCode)
+	}
+
+	// すべてのセッションからログアウト
+	phone = newTestClient(t, app, userID)
+	res, err = laptop.Post(app.URL+"/sessions/revoke_all", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login" {
+		t.Fatalf("revoke_all: status %d, location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+	if got := whoami(t, app, phone); got != 0 {
+		t.Errorf("after revoke_all: phone whoami = %d", got)
+	}
+	if got := whoami(t, app, laptop); got != 0 {
+		t.Errorf("after revoke_all: laptop whoami = %d", got)
+	}
+	if ids := userSessionIDs(t, userID); len(ids) != 0 {
+		t.Errorf("after revoke_all: sessions = %v", ids)
+	}
+	if got := whoami(t, app, other); got != otherID {
+		t.Errorf("other user was logged out: whoami = %d", got)
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/labstack/echo"
+)
+
+const (
+	sidebarCachePrefix    = "SIDEBAR-"
+	sidebarGenerationKey  = "SIDEBAR-GENERATION"
+	sidebarCacheTTL       = 10
+	maxSidebarSections    = 20
+	maxSidebarSectionName = 64
+	sidebarStarredGroup   = "お気に入り"
+	sidebarUngroupedGroup = "チャンネル"
+)
+
+type SidebarSection struct {
+	ID        int64     `db:"id"`
+	UserID    int64     `db:"user_id"`
+	Name      string    `db:"name"`
+	Position  int64     `db:"position"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// ユーザごとのチャンネルの設定。行がなければすべて既定値
+type UserChannel struct {
+	ChannelInfo
+	Starred   bool        `db:"starred"`
+	Muted     bool        `db:"muted"`
+	Notify    NotifyLevel `db:"notify"`
+	SectionID int64       `db:"section_id"`
+}
+
+type SidebarGroup struct {
+	Name     string
+	Channels []ChannelInfo
+}
+
+// Sidebar は base.html の左側に出すチャンネル一覧
+// お気に入り、ユーザが作ったセクション、それ以外の順に並べ、ミュート中のチャンネルは出さない
+type Sidebar struct {
+	Groups []SidebarGroup
+	Muted  int
+}
+
+type cachedSidebar struct {
+	Generation int64
+	Sidebar    *Sidebar
+}
+
+func makeSidebarCacheKey(userID int64) string {
+	return sidebarCachePrefix + strconv.FormatInt(userID, 10)
+}
+
+// queryUserChannels はアーカイブされていないチャンネルを最近の発言順に返す
+func queryUserChannels(userID int64) ([]UserChannel, error) {
+	res := []UserChannel{}
+	err := db.Select(&res,
+		"SELECT c.*, COALESCE(uc.starred, 0) AS starred, COALESCE(uc.muted, 0) AS muted,"+
+			" COALESCE(uc.notify, 'all') AS notify, COALESCE(uc.section_id, 0) AS section_id FROM channel AS c"+
+			" LEFT JOIN user_channel AS uc ON uc.channel_id = c.id AND uc.user_id = ?"+
+			" WHERE c.archived_at IS NULL ORDER BY c.updated_at DESC, c.id",
+		userID)
+	return res, err
+}
+
+// getUserChannel はチャンネル1件分の設定を返す
+func getUserChannel(userID int64, ch *ChannelInfo) (*UserChannel, error) {
+	uc := UserChannel{ChannelInfo: *ch, Notify: NotifyAll}
+	err := db.QueryRow("SELECT starred, muted, notify, section_id FROM user_channel WHERE user_id = ? AND channel_id = ?",
+		userID, ch.ID).Scan(&uc.Starred, &uc.Muted, &uc.Notify, &uc.SectionID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	return &uc, nil
+}
+
+func querySidebarSections(userID int64) ([]SidebarSection, error) {
+	res := []SidebarSection{}
+	err := db.Select(&res, "SELECT * FROM sidebar_section WHERE user_id = ? ORDER BY position, id", userID)
+	return res, err
+}
+
+func buildSidebar(userID int64) (*Sidebar, error) {
+	channels, err := queryUserChannels(userID)
+	if err != nil {
+		return nil, err
+	}
+	sections, err := querySidebarSections(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	starred := SidebarGroup{Name: sidebarStarredGroup}
+	ungrouped := SidebarGroup{Name: sidebarUngroupedGroup}
+	groups := make([]SidebarGroup, len(sections))
+	index := map[int64]int{}
+	for i, s := range sections {
+		groups[i].Name = s.Name
+		index[s.ID] = i
+	}
+
+	sb := &Sidebar{}
+	for _, ch := range channels {
+		switch i, ok := index[ch.SectionID]; {
+		case ch.Muted:
+			sb.Muted++
+		case ch.Starred:
+			starred.Channels = append(starred.Channels, ch.ChannelInfo)
+		case ok:
+			groups[i].Channels = append(groups[i].Channels, ch.ChannelInfo)
+		default:
+			ungrouped.Channels = append(ungrouped.Channels, ch.ChannelInfo)
+		}
+	}
+
+	if len(starred.Channels) > 0 {
+		sb.Groups = append(sb.Groups, starred)
+	}
+	sb.Groups = append(sb.Groups, groups...)
+	sb.Groups = append(sb.Groups, ungrouped)
+	return sb, nil
+}
+
+// querySidebar はキャッシュがあればそれを返す
+// 並び順は発言のたびに変わるので、キャッシュは sidebarCacheTTL 秒で捨てる
+func querySidebar(userID int64) (*Sidebar, error) {
+	r, err := NewRedisful()
+	if err != nil {
+		return buildSidebar(userID)
+	}
+	defer r.Close()
+
+	key := makeSidebarCacheKey(userID)
+	vals, err := redis.ByteSlices(r.Conn.Do("MGET", key, sidebarGenerationKey))
+	if err != nil {
+		log.Println(err, "IN querySidebar")
+		return buildSidebar(userID)
+	}
+	gen, _ := strconv.ParseInt(string(vals[1]), 10, 64)
+	if vals[0] != nil {
+		var cached cachedSidebar
+		if err := json.Unmarshal(vals[0], &cached); err == nil && cached.Generation == gen {
+			return cached.Sidebar, nil
+		}
+	}
+
+	sb, err := buildSidebar(userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.SetDataToCacheWithExpire(key, cachedSidebar{gen, sb}, sidebarCacheTTL); err != nil {
+		log.Println(err, "IN querySidebar")
+	}
+	return sb, nil
+}
+
+// invalidateSidebar はそのユーザのキャッシュを捨てる
+func invalidateSidebar(userID int64) {
+	r, err := NewRedisful()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	r.DeleteDataInCache(makeSidebarCacheKey(userID))
+}
+
+// invalidateAllSidebars はチャンネルの追加や名前の変更で全員のキャッシュを捨てる
+func invalidateAllSidebars() {
+	r, err := NewRedisful()
+	if err != nil {
+		return
+	}
+	defer r.Close()
+	r.IncrementDataInCache(sidebarGenerationKey)
+}
+
+func getSidebarSection(userID, sectionID int64) (*SidebarSection, error) {
+	sections, err := querySidebarSections(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range sections {
+		if s.ID == sectionID {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func validSidebarSectionName(name string) bool {
+	return name != "" && utf8.RuneCountInString(name) <= maxSidebarSectionName
+}
+
+// isLocalPath は p が同じサイト内のパスかどうか
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+// redirectBack は next が同じサイト内のパスならそこへ、そうでなければ fallback へ戻す
+func redirectBack(c echo.Context, fallback string) error {
+	next := c.FormValue("next")
+	if !isLocalPath(next) {
+		next = fallback
+	}
+	return c.Redirect(http.StatusSeeOther, next)
+}
+
+//request handlers
+
+func getSidebarSettings(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+	channels, err := queryUserChannels(self.ID)
+	if err != nil {
+		return err
+	}
+	sections, err := querySidebarSections(self.ID)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, "sidebar", map[string]interface{}{
+		"ChannelID":    0,
+		"Sidebar":      sidebar,
+		"User":         self,
+		"UserChannels": channels,
+		"Sections":     sections,
+	})
+}
+
+func postSidebarSection(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if !validSidebarSectionName(name) {
+		return ErrBadReqeust
+	}
+	sections, err := querySidebarSections(self.ID)
+	if err != nil {
+		return err
+	}
+	if len(sections) >= maxSidebarSections {
+		return ErrBadReqeust
+	}
+
+	var position int64 = 1
+	if len(sections) > 0 {
+		position = sections[len(sections)-1].Position + 1
+	}
+
+	_, err = db.Exec("INSERT INTO sidebar_section (user_id, name, position, created_at) VALUES (?, ?, ?, NOW())",
+		self.ID, name, position)
+	if err != nil {
+		return err
+	}
+	invalidateSidebar(self.ID)
+	return c.Redirect(http.StatusSeeOther, "/sidebar")
+}
+
+func postRenameSidebarSection(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	sectionID, err := strconv.ParseInt(c.Param("section_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	name := strings.TrimSpace(c.FormValue("name"))
+	if !validSidebarSectionName(name) {
+		return ErrBadReqeust
+	}
+
+	res, err := db.Exec("UPDATE sidebar_section SET name = ? WHERE id = ? AND user_id = ?", name, sectionID, self.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if s, err := getSidebarSection(self.ID, sectionID); err != nil {
+			return err
+		} else if s == nil {
+			return echo.ErrNotFound
+		}
+	}
+	invalidateSidebar(self.ID)
+	return c.Redirect(http.StatusSeeOther, "/sidebar")
+}
+
+func postDeleteSidebarSection(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	sectionID, err := strconv.ParseInt(c.Param("section_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec("DELETE FROM sidebar_section WHERE id = ? AND user_id = ?", sectionID, self.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.ErrNotFound
+	}
+	// セクション内のチャンネルは「チャンネル」に戻す
+	_, err = tx.Exec("UPDATE user_channel SET section_id = 0 WHERE user_id = ? AND section_id = ?", self.ID, sectionID)
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	invalidateSidebar(self.ID)
+	return c.Redirect(http.StatusSeeOther, "/sidebar")
+}
+
+// postChannelSidebar はフォームにある項目(starred, muted, notify, section_id)だけを更新する
+func postChannelSidebar(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	chID, err := strconv.ParseInt(c.Param("channel_id"), 10, 64)
+	if err != nil || chID <= 0 {
+		return ErrBadReqeust
+	}
+	ch, err := getChannelInfo(chID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return echo.ErrNotFound
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, name := range []string{"starred", "muted"} {
+		s := c.FormValue(name)
+		if s == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return ErrBadReqeust
+		}
+		sets = append(sets, name+" = ?")
+		args = append(args, b)
+	}
+	if s := c.FormValue("notify"); s != "" {
+		if !validNotifyLevel(NotifyLevel(s)) {
+			return ErrBadReqeust
+		}
+		sets = append(sets, "notify = ?")
+		args = append(args, s)
+	}
+	if s := c.FormValue("section_id"); s != "" {
+		sectionID, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return ErrBadReqeust
+		}
+		if sectionID != 0 {
+			if sec, err := getSidebarSection(self.ID, sectionID); err != nil {
+				return err
+			} else if sec == nil {
+				return ErrBadReqeust
+			}
+		}
+		sets = append(sets, "section_id = ?")
+		args = append(args, sectionID)
+	}
+	if len(sets) == 0 {
+		return ErrBadReqeust
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO user_channel (user_id, channel_id, updated_at) VALUES (?, ?, NOW())",
+		self.ID, chID)
+	if err != nil {
+		return err
+	}
+	args = append(args, self.ID, chID)
+	_, err = db.Exec("UPDATE user_channel SET "+strings.Join(sets, ", ")+", updated_at = NOW()"+
+		" WHERE user_id = ? AND channel_id = ?", args...)
+	if err != nil {
+		return err
+	}
+	invalidateSidebar(self.ID)
+	return redirectBack(c, fmt.Sprintf("/channel/%v", chID))
+}
@@ -6,30 +6,59 @@ import (
 )
 
 type User struct {
-	ID          int64     `json:"-" db:"id"`
-	Name        string    `json:"name" db:"name"`
-	Salt        string    `json:"-" db:"salt"`
-	Password    string    `json:"-" db:"password"`
-	DisplayName string    `json:"display_name" db:"display_name"`
-	AvatarIcon  string    `json:"avatar_icon" db:"avatar_icon"`
-	CreatedAt   time.Time `json:"-" db:"created_at"`
+	ID          int64  `json:"-" db:"id"`
+	Name        string `json:"name" db:"name"`
+	Salt        string `json:"-" db:"salt"`
+	Password    string `json:"-" db:"password"`
+	DisplayName string `json:"display_name" db:"display_name"`
+	AvatarIcon  string `json:"avatar_icon" db:"avatar_icon"`
+	// アップロードしたアイコンのサムネイル。無ければ空で、AvatarIcon を使う
+	AvatarIcon32  string     `json:"avatar_icon_32" db:"avatar_icon_32"`
+	AvatarIcon64  string     `json:"avatar_icon_64" db:"avatar_icon_64"`
+	AvatarIcon128 string     `json:"avatar_icon_128" db:"avatar_icon_128"`
+	Role          Role       `json:"-" db:"role"`
+	CreatedAt     time.Time  `json:"-" db:"created_at"`
+	DeletedAt     *time.Time `json:"-" db:"deleted_at"`
+	BannedAt      *time.Time `json:"-" db:"banned_at"`
 }
 
 type Message struct {
-	ID        int64     `db:"id"`
-	ChannelID int64     `db:"channel_id"`
-	UserID    int64     `db:"user_id"`
-	Content   string    `db:"content"`
-	CreatedAt time.Time `db:"created_at"`
-	User      User
+	ID        int64  `db:"id"`
+	ChannelID int64  `db:"channel_id"`
+	UserID    int64  `db:"user_id"`
+	Content   string `db:"content"`
+	Kind      string `db:"kind"`
+	// 空でなければ User の表示名とアイコンの代わりに出す(incoming webhook)
+	// SenderIcon は iconStore に置いたアイコンの名前
+	SenderName string    `db:"sender_name"`
+	SenderIcon string    `db:"sender_icon"`
+	CreatedAt  time.Time `db:"created_at"`
+	User       User
+	// loadAttachments で読み込む
+	Attachments []Attachment `db:"-"`
+}
+
+// Thumbnail は size 以上で一番小さいサムネイルを返す。無ければ元のアイコン
+func (u User) Thumbnail(size int) string {
+	for _, t := range []struct {
+		size int
+		name string
+	}{{32, u.AvatarIcon32}, {64, u.AvatarIcon64}, {128, u.AvatarIcon128}} {
+		if size <= t.size && t.name != "" {
+			return t.name
+		}
+	}
+	return u.AvatarIcon
 }
 
 type ChannelInfo struct {
-	ID          int64     `db:"id"`
-	Name        string    `db:"name"`
-	Description string    `db:"description"`
-	UpdatedAt   time.Time `db:"updated_at"`
-	CreatedAt   time.Time `db:"created_at"`
+	ID          int64      `db:"id"`
+	Name        string     `db:"name"`
+	Description string     `db:"description"`
+	CreatedBy   int64      `db:"created_by"`
+	UpdatedAt   time.Time  `db:"updated_at"`
+	CreatedAt   time.Time  `db:"created_at"`
+	ArchivedAt  *time.Time `db:"archived_at"`
 }
 
 type Renderer struct {
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/labstack/echo"
+	"github.com/labstack/echo-contrib/session"
+)
+
+// RFC 6238 (HMAC-SHA1, 30秒, 6桁)
+const (
+	totpIssuer    = "Isubata"
+	totpPeriod    = 30
+	totpDigits    = 6
+	totpSkew      = 1
+	recoveryCodes = 10
+
+	// パスワード確認から2段階目までの猶予(秒)
+	totpPendingTTL = 300
+)
+
+// テストで時刻を固定できるようにする
+var totpNow = time.Now
+
+// コードを totpDigits 桁に切り詰めるための 10^totpDigits
+var totpModulus = func() uint32 {
+	m := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		m *= 10
+	}
+	return m
+}()
+
+type UserTOTP struct {
+	UserID       int64      `db:"user_id"`
+	Secret       string     `db:"secret"`
+	LastUsedStep int64      `db:"last_used_step"`
+	EnabledAt    *time.Time `db:"enabled_at"`
+	CreatedAt    time.Time  `db:"created_at"`
+}
+
+func generateTOTPSecret() string {
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(securecookie.GenerateRandomKey(20))
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCode(secret string, step int64) (string, error) {
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%totpModulus), nil
+}
+
+// verifyTOTP は前後 totpSkew ステップまで許し、一致したステップを返す
+// lastUsedStep 以前のステップは再利用になるので受け付けない
+func verifyTOTP(secret, code string, lastUsedStep int64, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := totpStep(t)
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastUsedStep {
+			continue
+		}
+		expected, err := totpCode(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func totpProvisioningURI(accountName, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", totpIssuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", fmt.Sprint(totpDigits))
+	v.Set("period", fmt.Sprint(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+accountName) + "?" + v.Encode()
+}
+
+func getUserTOTP(userID int64) (*UserTOTP, error) {
+	t := UserTOTP{}
+	if err := db.Get(&t, "SELECT * FROM user_totp WHERE user_id = ?", userID); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &t, nil
+}
+
+func totpEnabled(userID int64) (bool, error) {
+	t, err := getUserTOTP(userID)
+	if err != nil {
+		return false, err
+	}
+	return t != nil && t.EnabledAt != nil, nil
+}
+
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.Replace(strings.TrimSpace(code), "-", "", -1))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(code)))
+}
+
+// 古いリカバリーコードを捨てて作り直す。平文は呼び出し元で一度だけ表示する
+func regenerateRecoveryCodes(userID int64) ([]string, error) {
+	tx, err := db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("DELETE FROM totp_recovery_code WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, 0, recoveryCodes)
+	for i := 0; i < recoveryCodes; i++ {
+		s := strings.ToLower(secureRandomString(10))
+		code := s[:5] + "-" + s[5:]
+		_, err = tx.Exec("INSERT INTO totp_recovery_code (user_id, code_hash, created_at) VALUES (?, ?, NOW())",
+			userID, hashRecoveryCode(code))
+		if err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, tx.Commit()
+}
+
+func useRecoveryCode(userID int64, code string) (bool, error) {
+	res, err := db.Exec(
+		"UPDATE totp_recovery_code SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL LIMIT 1",
+		userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+// verifySecondFactor は TOTP のコードかリカバリーコードを検証する
+func verifySecondFactor(t *UserTOTP, code string) (bool, error) {
+	if step, ok := verifyTOTP(t.Secret, code, t.LastUsedStep, totpNow()); ok {
+		// 同じステップのコードを同時に使われないよう条件付きで更新する
+		res, err := db.Exec("UPDATE user_totp SET last_used_step = ? WHERE user_id = ? AND last_used_step < ?",
+			step, t.UserID, step)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		return n == 1, err
+	}
+	return useRecoveryCode(t.UserID, code)
+}
+
+// パスワード確認が済んだユーザをセッションに仮置きする
+func sessSetTOTPPending(c echo.Context, userID int64) {
+	sess, _ := session.Get("session", c)
+	sess.Values["totp_user_id"] = userID
+	sess.Values["totp_started_at"] = totpNow().Unix()
+	sess.Save(c.Request(), c.Response())
+}
+
+func sessTOTPPending(c echo.Context) int64 {
+	sess, _ := session.Get("session", c)
+	userID, _ := sess.Values["totp_user_id"].(int64)
+	startedAt, _ := sess.Values["totp_started_at"].(int64)
+	if userID == 0 || totpNow().Unix()-startedAt > totpPendingTTL {
+		return 0
+	}
+	return userID
+}
+
+func sessClearTOTPPending(c echo.Context) {
+	sess, _ := session.Get("session", c)
+	delete(sess.Values, "totp_user_id")
+	delete(sess.Values, "totp_started_at")
+}
+
+//request handlers
+
+func getLoginTOTP(c echo.Context) error {
+	if sessTOTPPending(c) == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	return c.Render(http.StatusOK, "login_totp", map[string]interface{}{
+		"ChannelID": 0,
+		"User":      nil,
+	})
+}
+
+func postLoginTOTP(c echo.Context) error {
+	userID := sessTOTPPending(c)
+	if userID == 0 {
+		return c.Redirect(http.StatusSeeOther, "/login")
+	}
+	user, err := getUser(userID)
+	if err != nil {
+		return err
+	}
+	// パスワードを確かめた後に BAN されていることもある
+	if user == nil || user.BannedAt != nil || user.Role == RoleBot {
+		sessClearTOTPPending(c)
+		return echo.ErrForbidden
+	}
+	ip := requestRemoteAddr(c.Request())
+	if lockout := loginLockedOut(user.Name, ip); lockout > 0 {
+		return tooManyRequests(c, lockout)
+	}
+
+	t, err := getUserTOTP(userID)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.EnabledAt == nil {
+		return echo.ErrForbidden
+	}
+	ok, err := verifySecondFactor(t, c.FormValue("code"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		recordLoginFailure(user.Name, ip)
+		return echo.ErrForbidden
+	}
+	clearLoginFailures(user.Name, ip)
+
+	sessClearTOTPPending(c)
+	sessSetUserID(c, userID)
+	return c.Redirect(http.StatusSeeOther, "/")
+}
+
+func getAccountTOTP(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	t, err := getUserTOTP(self.ID)
+	if err != nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"ChannelID":   0,
+		"Sidebar":     sidebar,
+		"User":        self,
+		"Enabled":     t != nil && t.EnabledAt != nil,
+		"HasPassword": self.Password != "",
+	}
+	// 確認待ちの secret は POST /account/totp/setup で作る
+	if t != nil && t.EnabledAt == nil {
+		data["Secret"] = t.Secret
+		data["ProvisioningURI"] = totpProvisioningURI(self.Name, t.Secret)
+	}
+	return c.Render(http.StatusOK, "totp", data)
+}
+
+// postAccountTOTPSetup は確認待ちの secret を作る
+// 二重に送られても、先に作った secret をそのまま使う
+func postAccountTOTPSetup(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT IGNORE INTO user_totp (user_id, secret, last_used_step, created_at) VALUES (?, ?, 0, NOW())",
+		self.ID, generateTOTPSecret())
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/account/totp")
+}
+
+func postAccountTOTPConfirm(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	t, err := getUserTOTP(self.ID)
+	if err != nil {
+		return err
+	}
+	if t == nil || t.EnabledAt != nil {
+		return ErrBadReqeust
+	}
+	step, ok := verifyTOTP(t.Secret, c.FormValue("code"), t.LastUsedStep, totpNow())
+	if !ok {
+		return echo.ErrForbidden
+	}
+	_, err = db.Exec("UPDATE user_totp SET last_used_step = ?, enabled_at = NOW() WHERE user_id = ?", step, self.ID)
+	if err != nil {
+		return err
+	}
+	codes, err := regenerateRecoveryCodes(self.ID)
+	if err != nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "totp", map[string]interface{}{
+		"ChannelID":     0,
+		"Sidebar":       sidebar,
+		"User":          self,
+		"Enabled":       true,
+		"RecoveryCodes": codes,
+		"HasPassword":   self.Password != "",
+	})
+}
+
+func postAccountTOTPRecoveryCodes(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	ok, err := verifyReauth(c, self, c.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.ErrForbidden
+	}
+	if enabled, err := totpEnabled(self.ID); err != nil {
+		return err
+	} else if !enabled {
+		return ErrBadReqeust
+	}
+	codes, err := regenerateRecoveryCodes(self.ID)
+	if err != nil {
+		return err
+	}
+
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+	return c.Render(http.StatusOK, "totp", map[string]interface{}{
+		"ChannelID":     0,
+		"Sidebar":       sidebar,
+		"User":          self,
+		"Enabled":       true,
+		"RecoveryCodes": codes,
+		"HasPassword":   self.Password != "",
+	})
+}
+
+func postAccountTOTPDisable(c echo.Context) error {
+	self, err := ensureLogin(c)
+	if self == nil {
+		return err
+	}
+
+	ok, err := verifyReauth(c, self, c.FormValue("password"))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return echo.ErrForbidden
+	}
+	if _, err := db.Exec("DELETE FROM user_totp WHERE user_id = ?", self.ID); err != nil {
+		return err
+	}
+	if _, err := db.Exec("DELETE FROM totp_recovery_code WHERE user_id = ?", self.ID); err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, "/account")
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/base32"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// RFC 6238 付録 B の SHA1 の鍵 "12345678901234567890"
+var rfc6238Secret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+// fixTOTPNow は totpNow を now に固定し、元に戻す関数を返す
+func fixTOTPNow(now time.Time) func() {
+	saved := totpNow
+	totpNow = func() time.Time { return now }
+	return func() { totpNow = saved }
+}
+
+func TestTOTPCodeRFC6238(t *testing.T) {
+	// 付録 B は8桁なので、下 totpDigits 桁と比べる
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	} {
+		got, err := totpCode(rfc6238Secret, totpStep(time.Unix(tc.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := tc.code[len(tc.code)-totpDigits:]; got != want {
+			t.Errorf("T=%d: got %s, want %s", tc.unix, got, want)
+		}
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+	for offset := int64(-2); offset <= 2; offset++ {
+		code, err := totpCode(rfc6238Secret, step+offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := verifyTOTP(rfc6238Secret, code, 0, now)
+		want := offset >= -totpSkew && offset <= totpSkew
+		if ok != want {
+			t.Errorf("offset %d: ok = %v, want %v", offset, ok, want)
+		}
+		if ok && got != step+offset {
+			t.Errorf("offset %d: step = %d, want %d", offset, got, step+offset)
+		}
+	}
+	if _, ok := verifyTOTP(rfc6238Secret, "12345", 0, now); ok {
+		t.Error("accepted a short code")
+	}
+}
+
+func TestVerifyTOTPRejectsUsedStep(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	step := totpStep(now)
+	code, _ := totpCode(rfc6238Secret, step)
+	if _, ok := verifyTOTP(rfc6238Secret, code, step, now); ok {
+		t.Error("accepted the code of last_used_step")
+	}
+	prev, _ := totpCode(rfc6238Secret, step-1)
+	if _, ok := verifyTOTP(rfc6238Secret, prev, step, now); ok {
+		t.Error("accepted a code older than last_used_step")
+	}
+}
+
+func TestVerifySecondFactorReplay(t *testing.T) {
+	requireDB(t)
+	now := time.Unix(1234567890, 0)
+	defer fixTOTPNow(now)()
+	userID := int64(900000000) + int64(time.Now().UnixNano()%1000000)
+	defer db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+
+	_, err := db.Exec("INSERT INTO user_totp (user_id, secret, last_used_step, enabled_at, created_at)"+
+		" VALUES (?, ?, 0, NOW(), NOW())", userID, rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(rfc6238Secret, totpStep(now))
+	for i, want := range []bool{true, false} {
+		ut, err := getUserTOTP(userID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, err := verifySecondFactor(ut, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("attempt %d: ok = %v, want %v", i+1, ok, want)
+		}
+	}
+	ut, _ := getUserTOTP(userID)
+	if ut.LastUsedStep != totpStep(now) {
+		t.Errorf("last_used_step = %d, want %d", ut.LastUsedStep, totpStep(now))
+	}
+}
+
+func TestRecoveryCodesAreSingleUse(t *testing.T) {
+	requireDB(t)
+	defer fixTOTPNow(time.Unix(1234567890, 0))()
+	userID := int64(910000000) + int64(time.Now().UnixNano()%1000000)
+	defer db.Exec("DELETE FROM totp_recovery_code WHERE user_id = ?", userID)
+
+	codes, err := regenerateRecoveryCodes(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodes {
+		t.Fatalf("got %d codes", len(codes))
+	}
+	ut := &UserTOTP{UserID: userID, Secret: rfc6238Secret}
+	for i, want := range []bool{true, false} {
+		ok, err := verifySecondFactor(ut, codes[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Fatalf("attempt %d: ok = %v, want %v", i+1, ok, want)
+		}
+	}
+	// ハイフンを抜いたり前後に空白があったりしても通る
+	ok, err := useRecoveryCode(userID, "  "+codes[1][:5]+codes[1][6:]+" ")
+	if err != nil || !ok {
+		t.Fatalf("normalized code: ok = %v, err = %v", ok, err)
+	}
+
+	// 作り直すと古いコードは使えない
+	old := codes[2]
+	if _, err := regenerateRecoveryCodes(userID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := useRecoveryCode(userID, old); ok {
+		t.Error("accepted a code from the previous set")
+	}
+}
+
+// GET では何も作らず、POST /account/totp/setup を二重に送っても secret は1つ
+func TestAccountTOTPSetup(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("totpsetup")
+	userID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	defer db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+
+	e, app := newTestApp(t)
+	defer app.Close()
+	e.GET("/account/totp", getAccountTOTP)
+	e.POST("/account/totp/setup", postAccountTOTPSetup)
+	client := newTestClient(t, app, userID)
+
+	get := func() string {
+		res, err := client.Get(app.URL + "/account/totp")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("GET: status %d", res.StatusCode)
+		}
+		return string(body)
+	}
+	if body := get(); !strings.Contains(body, `action="/account/totp/setup"`) {
+		t.Error("setup form is not shown")
+	}
+	if ut, err := getUserTOTP(userID); err != nil || ut != nil {
+		t.Fatalf("GET created a secret: %+v, err = %v", ut, err)
+	}
+
+	var wg sync.WaitGroup
+	statuses := make([]int, 2)
+	for i := range statuses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := client.PostForm(app.URL+"/account/totp/setup", nil)
+			if err != nil {
+				return
+			}
+			res.Body.Close()
+			statuses[i] = res.StatusCode
+		}(i)
+	}
+	wg.Wait()
+	for i, status := range statuses {
+		if status != http.StatusSeeOther {
+			t.Errorf("setup %d: status %d", i, status)
+		}
+	}
+	ut, err := getUserTOTP(userID)
+	if err != nil || ut == nil || ut.EnabledAt != nil {
+		t.Fatalf("user_totp = %+v, err = %v", ut, err)
+	}
+	if body := get(); !strings.Contains(body, ut.Secret) {
+		t.Error("pending secret is not shown")
+	}
+}
+
+// パスワードの後に BAN されたら、2段階目が正しくてもログインさせない
+func TestLoginTOTPRejectsBannedUser(t *testing.T) {
+	requireDB(t)
+	requireRedis(t)
+
+	name := testName("totpban")
+	userID := insertTestUser(t, name, RoleMember)
+	defer db.Exec("DELETE FROM user WHERE id = ?", userID)
+	if err := updatePassword(userID, "correct-password"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO user_totp (user_id, secret, last_used_step, enabled_at, created_at)"+
+		" VALUES (?, ?, 0, NOW(), NOW())", userID, rfc6238Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Exec("DELETE FROM user_totp WHERE user_id = ?", userID)
+	defer clearLoginFailures(name, "127.0.0.1")
+
+	e, app := newTestApp(t)
+	defer app.Close()
+	e.POST("/login", postLogin)
+	e.POST("/login/totp", postLoginTOTP)
+	client := newTestClient(t, app, 0)
+
+	res, err := client.PostForm(app.URL+"/login", url.Values{"name": {name}, "password": {"correct-password"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusSeeOther || res.Header.Get("Location") != "/login/totp" {
+		t.Fatalf("login: status %d, location %q", res.StatusCode, res.Header.Get("Location"))
+	}
+
+	if _, err := db.Exec("UPDATE user SET banned_at = NOW() WHERE id = ?", userID); err != nil {
+		t.Fatal(err)
+	}
+	code, _ := totpCode(rfc6238Secret, totpStep(totpNow()))
+	res, err = client.PostForm(app.URL+"/login/totp", url.Values{"code": {code}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Errorf("banned user: status %d", res.StatusCode)
+	}
+}
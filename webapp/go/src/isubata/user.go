@@ -1,21 +1,21 @@
 package main
 
 import (
-	"crypto/sha1"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/labstack/echo"
-	"github.com/labstack/echo-contrib/session"
 )
 
 func getUser(userID int64) (*User, error) {
 	u := User{}
-	if err := db.Get(&u, "SELECT * FROM user WHERE id = ?", userID); err != nil {
+	if err := db.Get(&u, "SELECT * FROM user WHERE id = ? AND deleted_at IS NULL", userID); err != nil {
 		if err == sql.ErrNoRows {
 			return nil, nil
 		}
@@ -24,18 +24,40 @@ func getUser(userID int64) (*User, error) {
 	return &u, nil
 }
 
+// reservedUserName は人が名乗れない名前。bot と incoming webhook のユーザ、退会済みユーザに使う
+// name の照合順序は大文字小文字を区別しないので、ここでも区別しない
+func reservedUserName(name string) bool {
+	lower := strings.ToLower(name)
+	if strings.HasPrefix(lower, "deleted-") || strings.HasPrefix(lower, "webhook-") {
+		return true
+	}
+	for _, b := range bots {
+		if lower == strings.ToLower(b.Name()) {
+			return true
+		}
+	}
+	return false
+}
+
 func register(name, password string) (int64, error) {
-	salt := randomString(20)
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(salt+password)))
+	digest, err := hashPassword(password)
+	if err != nil {
+		return 0, err
+	}
 
 	res, err := db.Exec(
 		"INSERT INTO user (name, salt, password, display_name, avatar_icon, created_at)"+
 			" VALUES (?, ?, ?, ?, ?, NOW())",
-		name, salt, digest, name, "default.png")
+		name, "", digest, name, "default.png")
+	if err != nil {
+		return 0, err
+	}
+	userID, err := res.LastInsertId()
 	if err != nil {
 		return 0, err
 	}
-	return res.LastInsertId()
+	setIdenticonAvatar(userID, name)
+	return userID, nil
 }
 
 //request handlers
@@ -43,7 +65,6 @@ func register(name, password string) (int64, error) {
 func getRegister(c echo.Context) error {
 	return c.Render(http.StatusOK, "register", map[string]interface{}{
 		"ChannelID": 0,
-		"Channels":  []ChannelInfo{},
 		"User":      nil,
 	})
 }
@@ -51,7 +72,7 @@ func getRegister(c echo.Context) error {
 func postRegister(c echo.Context) error {
 	name := c.FormValue("name")
 	pw := c.FormValue("password")
-	if name == "" || pw == "" {
+	if name == "" || pw == "" || reservedUserName(name) {
 		return ErrBadReqeust
 	}
 	userID, err := register(name, pw)
@@ -69,9 +90,9 @@ func postRegister(c echo.Context) error {
 
 func getLogin(c echo.Context) error {
 	return c.Render(http.StatusOK, "login", map[string]interface{}{
-		"ChannelID": 0,
-		"Channels":  []ChannelInfo{},
-		"User":      nil,
+		"ChannelID":   0,
+		"User":        nil,
+		"OIDCEnabled": getOIDCProvider() != nil,
 	})
 }
 
@@ -81,27 +102,54 @@ func postLogin(c echo.Context) error {
 	if name == "" || pw == "" {
 		return ErrBadReqeust
 	}
+	ip := requestRemoteAddr(c.Request())
+	if lockout := loginLockedOut(name, ip); lockout > 0 {
+		return tooManyRequests(c, lockout)
+	}
 
 	var user User
-	err := db.Get(&user, "SELECT * FROM user WHERE name = ?", name)
+	err := db.Get(&user, "SELECT * FROM user WHERE name = ? AND deleted_at IS NULL", name)
 	if err == sql.ErrNoRows {
+		recordLoginFailure(name, ip)
 		return echo.ErrForbidden
 	} else if err != nil {
 		return err
 	}
 
-	digest := fmt.Sprintf("%x", sha1.Sum([]byte(user.Salt+pw)))
-	if digest != user.Password {
+	ok, rehash, err := verifyPassword(&user, pw)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		recordLoginFailure(name, ip)
 		return echo.ErrForbidden
 	}
+	// bot と webhook のユーザはログインできない
+	if user.BannedAt != nil || user.Role == RoleBot {
+		return echo.ErrForbidden
+	}
+	if rehash {
+		if err := rehashPassword(user.ID, pw); err != nil {
+			log.Println(err, "IN postLogin")
+		}
+	}
+
+	enabled, err := totpEnabled(user.ID)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		// 失敗回数は2段階目が通るまで消さない
+		sessSetTOTPPending(c, user.ID)
+		return c.Redirect(http.StatusSeeOther, "/login/totp")
+	}
+	clearLoginFailures(name, ip)
 	sessSetUserID(c, user.ID)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 
 func getLogout(c echo.Context) error {
-	sess, _ := session.Get("session", c)
-	delete(sess.Values, "user_id")
-	sess.Save(c.Request(), c.Response())
+	sessClearUserID(c)
 	return c.Redirect(http.StatusSeeOther, "/")
 }
 func getProfile(c echo.Context) error {
@@ -110,8 +158,7 @@ func getProfile(c echo.Context) error {
 		return err
 	}
 
-	channels := []ChannelInfo{}
-	err = db.Select(&channels, "SELECT * FROM channel ORDER BY id")
+	sidebar, err := querySidebar(self.ID)
 	if err != nil {
 		return err
 	}
@@ -125,13 +172,20 @@ func getProfile(c echo.Context) error {
 	if err != nil {
 		return err
 	}
+	// Redis が落ちていてもプロフィールは見せる
+	lastSeen, err := getLastSeen(other.ID)
+	if err != nil {
+		log.Println(err, "IN getProfile")
+	}
 
 	return c.Render(http.StatusOK, "profile", map[string]interface{}{
 		"ChannelID":   0,
-		"Channels":    channels,
+		"Sidebar":     sidebar,
 		"User":        self,
 		"Other":       other,
 		"SelfProfile": self.ID == other.ID,
+		"LastSeen":    lastSeen,
+		"Online":      lastSeen != nil && time.Since(*lastSeen) < presenceTTL,
 	})
 }
 
@@ -141,8 +195,7 @@ func postProfile(c echo.Context) error {
 		return err
 	}
 
-	avatarName := ""
-	var avatarData []byte
+	var avatar *processedAvatar
 
 	if fh, err := c.FormFile("avatar_icon"); err == http.ErrMissingFile {
 		// no file upload
@@ -153,7 +206,7 @@ func postProfile(c echo.Context) error {
 		if dotPos < 0 {
 			return ErrBadReqeust
 		}
-		ext := fh.Filename[dotPos:]
+		ext := strings.ToLower(fh.Filename[dotPos:])
 		switch ext {
 		case ".jpg", ".jpeg", ".png", ".gif":
 			break
@@ -165,40 +218,60 @@ func postProfile(c echo.Context) error {
 		if err != nil {
 			return err
 		}
-		avatarData, _ = ioutil.ReadAll(file)
+		avatarData, _ := ioutil.ReadAll(file)
 		file.Close()
 
 		if len(avatarData) > avatarMaxBytes {
 			return ErrBadReqeust
 		}
-		avatarName = fmt.Sprintf("%x%s", sha1.Sum(avatarData), ext)
+		// 拡張子だけでは中身が画像とは限らないのでデコードして確かめる
+		if avatar, err = processAvatar(avatarData); err != nil {
+			return err
+		}
 	}
 
-	if avatarName != "" && len(avatarData) > 0 {
-		err = writeFile(avatarName, avatarData)
-		if err != nil {
+	if avatar != nil {
+		if err := saveAvatar(self.ID, avatar); err != nil {
 			fmt.Println(err, "IN PostProfile")
 			return err
 		}
-
-		if name := c.FormValue("display_name"); name != "" {
-			_, err := db.Exec("UPDATE user SET display_name = ?, avatar_icon = ? WHERE id = ?", name, avatarName, self.ID)
-			if err != nil {
-				return err
-			}
-		} else {
-			_, err = db.Exec("UPDATE user SET avatar_icon = ? WHERE id = ?", avatarName, self.ID)
-			if err != nil {
-				return err
-			}
-		}
-	} else if name := c.FormValue("display_name"); name != "" {
+	}
+	if name := c.FormValue("display_name"); name != "" {
 		_, err := db.Exec("UPDATE user SET display_name = ? WHERE id = ?", name, self.ID)
 		if err != nil {
 			return err
 		}
-
 	}
 
 	return c.Redirect(http.StatusSeeOther, "/")
 }
+
+// getIcon は nginx や Static で見つからなかったアイコンを BlobStore から返す
+// 名前は内容の sha1 なので ETag に使う
+func getIcon(c echo.Context) error {
+	name := c.Param("file_name")
+	// 消えたアイコン(GC や /initialize)に 304 を返さないよう、先にあることを確かめる
+	blob, err := iconStore.Get(name)
+	if err == ErrBlobNotFound {
+		return echo.ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	h := c.Response().Header()
+	etag := `"` + name + `"`
+	h.Set("ETag", etag)
+	h.Set("Cache-Control", "public, max-age=86400")
+	if c.Request().Header.Get("If-None-Match") == etag {
+		return c.NoContent(http.StatusNotModified)
+	}
+	if !blob.ModTime.IsZero() {
+		modTime := blob.ModTime.UTC().Truncate(time.Second)
+		if t, err := http.ParseTime(c.Request().Header.Get("If-Modified-Since")); err == nil && !modTime.After(t) {
+			return c.NoContent(http.StatusNotModified)
+		}
+		h.Set("Last-Modified", modTime.Format(http.TimeFormat))
+	}
+	return c.Blob(http.StatusOK, blobContentType(name), blob.Data)
+}
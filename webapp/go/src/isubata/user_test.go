@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestGetIconConditional(t *testing.T) {
+	dir, err := ioutil.TempDir("", "isubata-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s BlobStore) { iconStore = s }(iconStore)
+	iconStore = newLocalBlobStore(dir)
+
+	const name = "0123456789abcdef.png"
+	if err := iconStore.Put(name, []byte("image")); err != nil {
+		t.Fatal(err)
+	}
+
+	e := echo.New()
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/icons/"+name, nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetParamNames("file_name")
+		c.SetParamValues(name)
+		if err := getIcon(c); err != nil {
+			t.Fatal(err)
+		}
+		return rec
+	}
+
+	rec := get(nil)
+	etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+	if rec.Code != http.StatusOK || rec.Body.String() != "image" || etag == "" || lastModified == "" {
+		t.Fatalf("first GET: status %d, ETag %q, Last-Modified %q", rec.Code, etag, lastModified)
+	}
+
+	if rec := get(map[string]string{"If-None-Match": etag}); rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("If-None-Match: status %d", rec.Code)
+	}
+	if rec := get(map[string]string{"If-None-Match": `"other.png"`}); rec.Code != http.StatusOK {
+		t.Errorf("mismatched If-None-Match: status %d", rec.Code)
+	}
+
+	if rec := get(map[string]string{"If-Modified-Since": lastModified}); rec.Code != http.StatusNotModified {
+		t.Errorf("If-Modified-Since: status %d", rec.Code)
+	}
+	modTime, _ := http.ParseTime(lastModified)
+	before := modTime.Add(-time.Hour).Format(http.TimeFormat)
+	if rec := get(map[string]string{"If-Modified-Since": before}); rec.Code != http.StatusOK || rec.Body.String() != "image" {
+		t.Errorf("older If-Modified-Since: status %d", rec.Code)
+	}
+
+	// 消えたアイコンは ETag が合っていても 404
+	if err := iconStore.Delete(name); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/icons/"+name, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	c := e.NewContext(req, rec)
+	c.SetParamNames("file_name")
+	c.SetParamValues(name)
+	if err := getIcon(c); err != echo.ErrNotFound {
+		t.Errorf("deleted icon: err = %v, status %d", err, rec.Code)
+	}
+}
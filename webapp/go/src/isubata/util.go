@@ -1,10 +1,11 @@
 package main
 
 import (
+	crand "crypto/rand"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"math/rand"
+	"os"
 
 	"github.com/labstack/echo"
 )
@@ -30,6 +31,9 @@ func jsonifyMessage(m Message) (map[string]interface{}, error) {
 }
 
 func (r *Renderer) Render(w io.Writer, name string, data interface{}, c echo.Context) error {
+	if m, ok := data.(map[string]interface{}); ok {
+		m["CSRFToken"] = csrfToken(c)
+	}
 	return r.templates.ExecuteTemplate(w, name, data)
 }
 
@@ -45,6 +49,31 @@ func randomString(n int) string {
 	return string(b)
 }
 
+// パスワードやトークンなど推測されては困る値に使う
+func secureRandomString(n int) string {
+	buf := make([]byte, n)
+	if _, err := crand.Read(buf); err != nil {
+		panic(err)
+	}
+	z := len(LettersAndDigits)
+	b := make([]byte, n)
+	for i := range buf {
+		// 256 は 62 で割り切れないので偏らないよう捨てる
+		for int(buf[i]) >= 256/z*z {
+			crand.Read(buf[i : i+1])
+		}
+		b[i] = LettersAndDigits[int(buf[i])%z]
+	}
+	return string(b)
+}
+
+func envOrDefault(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
 func tAdd(a, b int64) int64 {
 	return a + b
 }
@@ -57,30 +86,35 @@ func tRange(a, b int64) []int64 {
 	return r
 }
 
-func writeFile(filename string, data []byte) error {
-	filepath := ICONS_PATH + filename
-	err := ioutil.WriteFile(filepath, data, 0644)
+// initializeImagesInDB は image テーブルのアイコンのうち、iconStore にまだ無いものだけを置く
+// iconStore が image テーブルそのものなら何もしない
+func initializeImagesInDB() error {
+	if s, ok := iconStore.(*mysqlBlobStore); ok && s.table == "image" {
+		return nil
+	}
+	stored, err := iconStore.List()
 	if err != nil {
 		return err
 	}
-	return nil
-}
+	exists := make(map[string]bool, len(stored))
+	for _, b := range stored {
+		exists[b.Name] = true
+	}
 
-func initializeImagesInDB() error {
-	rows, err := db.Query("SELECT name, data FROM image")
-	if err != nil {
+	names := []string{}
+	if err := db.Select(&names, "SELECT DISTINCT name FROM image WHERE name IS NOT NULL"); err != nil {
 		fmt.Println(err)
 		return err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var name string
+	for _, name := range names {
+		if exists[name] {
+			continue
+		}
 		var data []byte
-		if err := rows.Scan(&name, &data); err != nil {
+		if err := db.Get(&data, "SELECT data FROM image WHERE name = ? LIMIT 1", name); err != nil {
 			return err
 		}
-		err = writeFile(name, data)
-		if err != nil {
+		if err := iconStore.Put(name, data); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	maxWebhooksPerChannel = 20
+	maxWebhookName        = 64
+	maxWebhookText        = 4000
+	maxWebhookIconURL     = 255
+	maxWebhookIconBytes   = 1 << 20
+	// 取得したアイコンはこの大きさのサムネイルだけを置く
+	webhookIconSize = 128
+	// プロセスごとに覚えておく URL の数。超えたら忘れる
+	maxWebhookIconCache = 1000
+)
+
+var (
+	// アイコンはサーバが取得して iconStore に置き直し、ブラウザから外部へ直接取りに行かせない
+	webhookIconClient = func() *http.Client {
+		client := newPublicHTTPClient(5 * time.Second)
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" || len(via) >= 3 {
+				return http.ErrUseLastResponse
+			}
+			return nil
+		}
+		return client
+	}()
+
+	webhookIconMu    sync.Mutex
+	webhookIconCache = map[string]string{}
+)
+
+type IncomingWebhook struct {
+	ID        int64 `db:"id"`
+	ChannelID int64 `db:"channel_id"`
+	// 投稿者になる webhook 用の疑似ユーザ
+	UserID     int64      `db:"user_id"`
+	Name       string     `db:"name"`
+	TokenHash  string     `db:"token_hash"`
+	CreatedBy  int64      `db:"created_by"`
+	CreatedAt  time.Time  `db:"created_at"`
+	LastUsedAt *time.Time `db:"last_used_at"`
+	RevokedAt  *time.Time `db:"revoked_at"`
+}
+
+type webhookPayload struct {
+	Text     string `json:"text"`
+	Username string `json:"username"`
+	Icon     string `json:"icon"`
+}
+
+// トークンは作成時に一度だけ見せ、DB にはハッシュだけ残す
+func hashWebhookToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
+
+func webhookIdentity(c echo.Context) string {
+	return "hook:" + hashWebhookToken(c.Param("token"))
+}
+
+func webhookURL(c echo.Context, token string) string {
+	return c.Scheme() + "://" + c.Request().Host + "/hooks/" + token
+}
+
+func queryIncomingWebhooks(chID int64) ([]IncomingWebhook, error) {
+	hooks := []IncomingWebhook{}
+	err := db.Select(&hooks, "SELECT * FROM incoming_webhook WHERE channel_id = ? AND revoked_at IS NULL ORDER BY id", chID)
+	return hooks, err
+}
+
+func getIncomingWebhookByToken(token string) (*IncomingWebhook, error) {
+	h := IncomingWebhook{}
+	err := db.Get(&h, "SELECT * FROM incoming_webhook WHERE token_hash = ? AND revoked_at IS NULL", hashWebhookToken(token))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &h, nil
+}
+
+// createIncomingWebhook は疑似ユーザを作ってからフックを登録し、平文のトークンを返す
+func createIncomingWebhook(ch *ChannelInfo, createdBy int64, name string) (string, error) {
+	token := secureRandomString(40)
+
+	tx, err := db.Beginx()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// name は一意なので、衝突しないようトークンのハッシュの先頭を使う
+	res, err := tx.Exec("INSERT INTO user (name, salt, password, display_name, avatar_icon, role, created_at)"+
+		" VALUES (?, '', '', ?, 'default.png', ?, NOW())",
+		"webhook-"+hashWebhookToken(token)[:16], name, RoleBot)
+	if err != nil {
+		return "", err
+	}
+	userID, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec("INSERT INTO incoming_webhook (channel_id, user_id, name, token_hash, created_by, created_at)"+
+		" VALUES (?, ?, ?, ?, ?, NOW())",
+		ch.ID, userID, name, hashWebhookToken(token), createdBy)
+	if err != nil {
+		return "", err
+	}
+	return token, tx.Commit()
+}
+
+func validWebhookIcon(icon string) bool {
+	if icon == "" {
+		return true
+	}
+	if len(icon) > maxWebhookIconURL {
+		return false
+	}
+	u, err := url.Parse(icon)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// fetchWebhookIcon は icon の URL から画像を取得し、サムネイルを iconStore に置いてその名前を返す
+func fetchWebhookIcon(icon string) (string, error) {
+	webhookIconMu.Lock()
+	name, ok := webhookIconCache[icon]
+	webhookIconMu.Unlock()
+	if ok {
+		return name, nil
+	}
+
+	res, err := webhookIconClient.Get(icon)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("icon %s: %s", icon, res.Status)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxWebhookIconBytes+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxWebhookIconBytes {
+		return "", fmt.Errorf("icon %s: too large", icon)
+	}
+	avatar, err := processAvatar(data)
+	if err != nil {
+		return "", fmt.Errorf("icon %s: %v", icon, err)
+	}
+	thumb := avatar.Thumbnails[webhookIconSize]
+	if err := iconStore.Put(thumb.Name, thumb.Data); err != nil {
+		return "", err
+	}
+
+	webhookIconMu.Lock()
+	if len(webhookIconCache) >= maxWebhookIconCache {
+		webhookIconCache = map[string]string{}
+	}
+	webhookIconCache[icon] = thumb.Name
+	webhookIconMu.Unlock()
+	return thumb.Name, nil
+}
+
+// senderIconURL は sender_icon を表示する URL にする。iconStore の名前でないもの(外部の URL)は出さない
+func senderIconURL(name string) string {
+	if name == "" || strings.Contains(name, "/") {
+		return ""
+	}
+	return "/icons/" + name
+}
+
+// renderEditChannel は作成直後にだけ見せる URL やシークレットを extra で渡す
+func renderEditChannel(c echo.Context, self *User, ch *ChannelInfo, extra map[string]interface{}) error {
+	hooks, err := queryIncomingWebhooks(ch.ID)
+	if err != nil {
+		return err
+	}
+	outgoing, err := queryOutgoingWebhooks(ch.ID)
+	if err != nil {
+		return err
+	}
+	sidebar, err := querySidebar(self.ID)
+	if err != nil {
+		return err
+	}
+
+	data := map[string]interface{}{
+		"ChannelID":        ch.ID,
+		"Sidebar":          sidebar,
+		"User":             self,
+		"Channel":          ch,
+		"Webhooks":         hooks,
+		"OutgoingWebhooks": outgoing,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+	return c.Render(http.StatusOK, "edit_channel", data)
+}
+
+//request handlers
+
+func postIncomingWebhook(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+
+	name := strings.TrimSpace(c.FormValue("name"))
+	if name == "" || utf8.RuneCountInString(name) > maxWebhookName {
+		return ErrBadReqeust
+	}
+	hooks, err := queryIncomingWebhooks(ch.ID)
+	if err != nil {
+		return err
+	}
+	if len(hooks) >= maxWebhooksPerChannel {
+		return ErrBadReqeust
+	}
+
+	token, err := createIncomingWebhook(ch, self.ID, name)
+	if err != nil {
+		return err
+	}
+	return renderEditChannel(c, self, ch, map[string]interface{}{
+		"NewWebhookURL": webhookURL(c, token),
+	})
+}
+
+func postRevokeIncomingWebhook(c echo.Context) error {
+	self, ch, err := ensureChannelManager(c)
+	if self == nil {
+		return err
+	}
+
+	hookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return ErrBadReqeust
+	}
+	_, err = db.Exec("UPDATE incoming_webhook SET revoked_at = NOW() WHERE id = ? AND channel_id = ? AND revoked_at IS NULL",
+		hookID, ch.ID)
+	if err != nil {
+		return err
+	}
+	return c.Redirect(http.StatusSeeOther, fmt.Sprintf("/channel/%v/edit", ch.ID))
+}
+
+// postHook は JSON {"text": ..., "username": ..., "icon": ...} を受け取って投稿する
+func postHook(c echo.Context) error {
+	hook, err := getIncomingWebhookByToken(c.Param("token"))
+	if err != nil {
+		return err
+	}
+	if hook == nil {
+		return echo.ErrNotFound
+	}
+
+	var p webhookPayload
+	if err := c.Bind(&p); err != nil {
+		return ErrBadReqeust
+	}
+	p.Username = strings.TrimSpace(p.Username)
+	if p.Text == "" || utf8.RuneCountInString(p.Text) > maxWebhookText ||
+		utf8.RuneCountInString(p.Username) > maxWebhookName || !validWebhookIcon(p.Icon) {
+		return ErrBadReqeust
+	}
+
+	ch, err := getChannelInfo(hook.ChannelID)
+	if err != nil {
+		return err
+	}
+	if ch == nil {
+		return echo.ErrNotFound
+	}
+	if ch.ArchivedAt != nil {
+		return echo.ErrForbidden
+	}
+
+	// アイコンを取得できなくても投稿はする
+	var icon string
+	if p.Icon != "" {
+		if icon, err = fetchWebhookIcon(p.Icon); err != nil {
+			log.Println(err, "IN postHook")
+			icon = ""
+		}
+	}
+
+	id, err := insertMessage(Message{
+		ChannelID:  ch.ID,
+		UserID:     hook.UserID,
+		Kind:       MessageKindWebhook,
+		Content:    p.Text,
+		SenderName: p.Username,
+		SenderIcon: icon,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := db.Exec("UPDATE incoming_webhook SET last_used_at = NOW() WHERE id = ?", hook.ID); err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message_id": id,
+	})
+}
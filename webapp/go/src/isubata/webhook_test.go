@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestValidWebhookIcon(t *testing.T) {
+	cases := map[string]bool{
+		"":                              true,
+		"https://example.com/icon.png":  true,
+		"http://example.com/icon.png":   false,
+		"//example.com/icon.png":        false,
+		"javascript:alert(1)":           false,
+		"https:///icon.png":             false,
+		"data:image/png;base64,iVBORw0": false,
+	}
+	for icon, want := range cases {
+		if got := validWebhookIcon(icon); got != want {
+			t.Errorf("validWebhookIcon(%q) = %v, want %v", icon, got, want)
+		}
+	}
+}
+
+// アイコンはサーバが1度だけ取得し、iconStore に置いたサムネイルを返す
+func TestFetchWebhookIcon(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 300, 200))); err != nil {
+		t.Fatal(err)
+	}
+	requests := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/icon.png" {
+			w.Write([]byte("not an image"))
+			return
+		}
+		w.Write(buf.Bytes())
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "isubata-icons")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(s BlobStore) { iconStore = s }(iconStore)
+	iconStore = newLocalBlobStore(dir)
+	// httptest のサーバはループバックなので、このテストでは証明書だけ信頼するクライアントを使う
+	defer func(c *http.Client) { webhookIconClient = c }(webhookIconClient)
+	webhookIconClient = srv.Client()
+	defer func() { webhookIconCache = map[string]string{} }()
+
+	name, err := fetchWebhookIcon(srv.URL + "/icon.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob, err := iconStore.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := png.Decode(bytes.NewReader(blob.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != webhookIconSize || b.Dy() != webhookIconSize {
+		t.Errorf("icon size = %v", b)
+	}
+	if again, err := fetchWebhookIcon(srv.URL + "/icon.png"); err != nil || again != name || requests != 1 {
+		t.Errorf("second fetch: name = %q, err = %v, requests = %d", again, err, requests)
+	}
+	if senderIconURL(name) != "/icons/"+name {
+		t.Errorf("senderIconURL(%q) = %q", name, senderIconURL(name))
+	}
+
+	if _, err := fetchWebhookIcon(srv.URL + "/text"); err == nil {
+		t.Error("accepted a non-image icon")
+	}
+	if senderIconURL("https://example.com/icon.png") != "" {
+		t.Error("senderIconURL passed an external URL through")
+	}
+}
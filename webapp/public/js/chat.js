@@ -4,13 +4,72 @@ function append(msg) {
     var text = msg["content"]
     var name = msg["user"]["display_name"] + "@" + msg["user"]["name"]
     var date = msg["date"]
-    var icon = msg["user"]["avatar_icon"]
-    var p = $('<div class="media message"></div>')
+    var icon = '/icons/' + (msg["user"]["avatar_icon_128"] || msg["user"]["avatar_icon"])
+    var kind = msg["kind"] || "text"
+    // webhook は投稿ごとに表示名とアイコンを上書きできる
+    var sender = msg["sender"]
+    if (sender && sender["display_name"]) {
+        name = sender["display_name"]
+    }
+    if (sender && sender["icon_url"]) {
+        icon = sender["icon_url"]
+    }
+    var p = $('<div class="media message"></div>').addClass("message-" + kind)
 		var body = $('<div class="media-body">')
-    $('<img class="avatar d-flex align-self-start mr-3" alt="no avatar">').attr('src', '/icons/'+icon).appendTo(p)
-    $('<h5 class="mt-0"></h5>').append($('<a></a>').attr('href', '/profile/'+msg["user"]["name"]).text(name)).appendTo(body)
-    $('<p class="content"></p>').text(text).appendTo(body)
+    $('<img class="avatar d-flex align-self-start mr-3" alt="no avatar">').attr('src', icon).appendTo(p)
+    var h = $('<h5 class="mt-0"></h5>').append($('<a></a>').attr('href', '/profile/'+msg["user"]["name"]).text(name))
+    if (kind == "bot") {
+        h.append(' <span class="badge badge-info">BOT</span>')
+    } else if (kind == "webhook") {
+        h.append(' <span class="badge badge-secondary">WEBHOOK</span>')
+    }
+    h.appendTo(body)
+    if (kind == "me") {
+        $('<p class="content font-italic"></p>').text("* " + msg["user"]["display_name"] + " " + text).appendTo(body)
+    } else if (kind == "system") {
+        $('<p class="content text-muted"></p>').text(text).appendTo(body)
+    } else if (msg["content_html"]) {
+        // サーバでサニタイズ済み
+        $('<div class="content"></div>').html(msg["content_html"]).appendTo(body)
+    } else {
+        $('<p class="content"></p>').text(text).appendTo(body)
+    }
+    if (msg["attachments"]) {
+        var list = $('<ul class="list-unstyled attachments"></ul>')
+        msg["attachments"].forEach(function(a) {
+            var item = $('<li></li>')
+            if (a["is_image"]) {
+                var img = $('<img class="attachment-image">').attr('src', a["url"]).attr('alt', a["filename"])
+                $('<a target="_blank"></a>').attr('href', a["url"]).append(img).appendTo(item)
+            } else {
+                $('<a></a>').attr('href', a["url"]).text(a["filename"]).appendTo(item)
+                $('<span class="text-muted small"></span>').text(" (" + a["size"] + " bytes)").appendTo(item)
+            }
+            item.appendTo(list)
+        })
+        list.appendTo(body)
+    }
     $('<p class="message-date"></p>').text(date).appendTo(body)
+    var actions = $('<p class="message-actions small"></p>')
+    $('<a href="#"></a>').text("保存").click(function(e) {
+        e.preventDefault()
+        save_message(msg["id"])
+        $(this).text("保存済み")
+    }).appendTo(actions)
+    actions.append(" ")
+    $('<a href="#"></a>').text("1時間後にリマインド").click(function(e) {
+        e.preventDefault()
+        remind_message(msg["id"], "1h")
+        $(this).text("リマインド設定済み")
+    }).appendTo(actions)
+    if ($("#pins").data("can-pin")) {
+        actions.append(" ")
+        $('<a href="#"></a>').text("ピン留め").click(function(e) {
+            e.preventDefault()
+            pin_message(get_channel_id(), msg["id"])
+        }).appendTo(actions)
+    }
+    actions.appendTo(body)
     body.appendTo(p)
     p.appendTo("#timeline")
     last_message_id = Math.max(last_message_id, msg['id'])
@@ -35,6 +94,10 @@ function get_channel_id() {
     return "1"
 }
 
+function csrf_token() {
+    return $('meta[name="csrf-token"]').attr('content')
+}
+
 function fetch_unread(callback) {
     $.ajax({
         dataType: "json",
@@ -74,32 +137,48 @@ function get_message(callback) {
     })
 }
 
-function post_message(msg) {
+function post_message(msg, files) {
     channel_id = get_channel_id()
     if (channel_id == null) {
         console.error("channel_id is null")
         return
     }
 
+    var data = new FormData()
+    data.append("channel_id", channel_id)
+    data.append("message", msg)
+    data.append("_csrf", csrf_token())
+    for (var i = 0; files && i < files.length; i++) {
+        data.append("attachment", files[i])
+    }
+
     $.ajax({
         async: true,
         type: "POST",
         url: "/message",
-        data: {
-            channel_id: channel_id,
-            message: msg
-        },
+        data: data,
+        processData: false,
+        contentType: false,
+        error: function(xhr) {
+            // スラッシュコマンドの使い方の誤りなど
+            if (xhr.status == 400 && xhr.responseJSON && xhr.responseJSON.message) {
+                alert(xhr.responseJSON.message)
+            }
+        }
     })
 }
 
 function on_send_button() {
     var textarea = $("#chatbox-textarea")
+    var input = $("#chatbox-attachment")
     var msg = textarea.val()
-    if (msg == "") {
+    var files = input.length ? input[0].files : []
+    if (msg == "" && files.length == 0) {
         return
     }
-    post_message(msg)
+    post_message(msg, files)
     textarea.val("")
+    input.val("")
 }
 
 $(document).ready(function() {
@@ -128,7 +207,8 @@ $(document).ready(function() {
                 updated = false
                 json.forEach(function(channel) {
                     current_channel = channel.channel_id == channel_id
-                    if (current_channel && 0 < channel.unread) {
+                    // 開いているチャンネルはミュート中でも新着を読み込む
+                    if (current_channel && 0 < channel.unread + (channel.muted_unread || 0)) {
                       updated = true
                     }
                     var badge = $("#unread-" + channel.channel_id)
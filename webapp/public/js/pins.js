@@ -0,0 +1,67 @@
+function pin_message(channel_id, message_id) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/channel/" + channel_id + "/pins",
+        data: {
+            message_id: message_id,
+            _csrf: csrf_token()
+        },
+        success: function() {
+            window.location.reload()
+        }
+    })
+}
+
+function unpin_message(channel_id, message_id) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/channel/" + channel_id + "/pins/" + message_id + "/delete",
+        data: {
+            _csrf: csrf_token()
+        },
+        success: function() {
+            $("#pin-" + message_id).remove()
+        }
+    })
+}
+
+function save_message(message_id) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/saved/messages",
+        data: {
+            message_id: message_id,
+            _csrf: csrf_token()
+        }
+    })
+}
+
+function unsave_message(message_id) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/saved/messages/" + message_id + "/delete",
+        data: {
+            _csrf: csrf_token()
+        },
+        success: function() {
+            $("#saved-" + message_id).remove()
+        }
+    })
+}
+
+function remind_message(message_id, after) {
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/scheduled/reminders",
+        data: {
+            message_id: message_id,
+            after: after,
+            _csrf: csrf_token()
+        }
+    })
+}
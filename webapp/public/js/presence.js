@@ -0,0 +1,71 @@
+// 在席と入力中の表示。chat.js の get_channel_id と csrf_token を使う
+var PRESENCE_INTERVAL = 3000
+var TYPING_INTERVAL = 3000
+var last_typing_sent = 0
+
+function user_label(u) {
+    return u["display_name"] + "@" + u["name"]
+}
+
+function render_presence(json) {
+    var online = $("#presence-online").empty()
+    json.online.forEach(function(u, i) {
+        if (0 < i) {
+            online.append(", ")
+        }
+        $('<a></a>').attr('href', '/profile/' + u["name"]).text(user_label(u)).appendTo(online)
+    })
+
+    var typing = $("#typing")
+    if (json.typing.length == 0) {
+        typing.text("")
+    } else if (json.typing.length <= 3) {
+        typing.text(json.typing.map(user_label).join(", ") + " が入力中…")
+    } else {
+        typing.text(json.typing.length + "人が入力中…")
+    }
+}
+
+function send_presence() {
+    $.ajax({
+        dataType: "json",
+        async: true,
+        type: "POST",
+        url: "/channel/" + get_channel_id() + "/presence",
+        data: {
+            _csrf: csrf_token()
+        },
+        success: render_presence
+    })
+}
+
+function send_typing() {
+    var now = Date.now()
+    if (now - last_typing_sent < TYPING_INTERVAL) {
+        return
+    }
+    last_typing_sent = now
+    $.ajax({
+        async: true,
+        type: "POST",
+        url: "/channel/" + get_channel_id() + "/typing",
+        data: {
+            _csrf: csrf_token()
+        }
+    })
+}
+
+$(document).ready(function() {
+    if ($("#presence").length == 0) {
+        return
+    }
+    $("#chatbox-textarea").on("input", send_typing)
+    // 送信したら次の入力ですぐ知らせる
+    $("#chatbox-textarea").keydown(function(e) {
+        if (e.keyCode == 13 && !e.shiftKey) {
+            last_typing_sent = 0
+        }
+    })
+    send_presence()
+    setInterval(send_presence, PRESENCE_INTERVAL)
+})